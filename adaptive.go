@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// NewAdaptive returns an XZWriter that compresses to w, or, if the xz
+// executable cannot be found, a gzip.Writer, so the caller can degrade
+// instead of failing. The returned Format tells which one has been chosen,
+// e.g. to pick the file extension or the Content-Encoding: FormatGzip, or the
+// format configured for xz. The gzip.Writer uses the configured compression
+// level, but at least gzip.BestSpeed, and ignores all other options.
+// WithStoreOnly is not supported, as its raw stream has no format to report.
+func NewAdaptive(w io.Writer, opts ...Option) (io.WriteCloser, Format, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if o.storeOnly {
+		return nil, "", fmt.Errorf("%w: the adaptive writer does not support store-only mode", ErrOptionIllegal)
+	}
+
+	xz, err := NewWithOptions(context.Background(), w, opts...)
+	if err == nil {
+		format := xz.opts.format
+		if format == "" {
+			format = FormatXZ
+		}
+
+		return xz, format, nil
+	}
+
+	if !errors.Is(err, ErrXZNotFound) {
+		return nil, "", err
+	}
+
+	level := o.compressLevel
+	if level < gzip.BestSpeed {
+		level = gzip.BestSpeed
+	}
+
+	gz, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return gz, FormatGzip, nil
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/jwkohnen/xzwriter"
+)
+
+func TestAdaptive(t *testing.T) {
+	data := text(64 << 10)
+
+	var buf bytes.Buffer
+
+	// Without xz it falls back to gzip.
+	w, format, err := xzwriter.NewAdaptive(&buf, xzwriter.WithBinary("definitely-not-xz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if format != xzwriter.FormatGzip {
+		t.Errorf("format %q, want %q", format, xzwriter.FormatGzip)
+	}
+
+	writeAll(t, w, data)
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := io.ReadAll(gz); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("gzip: got %d bytes, %v", len(got), err)
+	}
+
+	// Illegal options are no reason to fall back.
+	_, _, err = xzwriter.NewAdaptive(io.Discard, xzwriter.WithBinary("definitely-not-xz"), xzwriter.WithCompressLevel(12))
+	if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+		t.Errorf("got %v, want ErrOptionIllegal", err)
+	}
+
+	// A raw stream has no format to report.
+	_, _, err = xzwriter.NewAdaptive(io.Discard, xzwriter.WithStoreOnly())
+	if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+		t.Errorf("store only: got %v, want ErrOptionIllegal", err)
+	}
+
+	requireXZ(t)
+
+	for _, tc := range []struct {
+		opts   []xzwriter.Option
+		format xzwriter.Format
+		args   []string
+	}{
+		{nil, xzwriter.FormatXZ, nil},
+		{[]xzwriter.Option{xzwriter.WithFormat(xzwriter.FormatLZMA)}, xzwriter.FormatLZMA, []string{"--format=lzma"}},
+	} {
+		buf.Reset()
+
+		w, format, err := xzwriter.NewAdaptive(&buf, tc.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if format != tc.format {
+			t.Errorf("format %q, want %q", format, tc.format)
+		}
+
+		writeAll(t, w, data)
+		assertRoundTrip(t, buf.Bytes(), data, tc.args...)
+	}
+}
+
+// writeAll writes data to w and closes it.
+func writeAll(t *testing.T, w io.WriteCloser, data []byte) {
+	t.Helper()
+
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
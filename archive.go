@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+)
+
+// CompressFS writes the tree of fsys as a tar archive compressed with xz to
+// w, like `tar -cJ`. The options are applied like with NewWithOptions.
+//
+// The entries are written in lexical order, as walked by fs.WalkDir, and
+// directories are included, so empty directories are preserved. Symbolic
+// links and other irregular files, such as devices, are skipped, because an
+// fs.FS cannot tell the target of a link.
+func CompressFS(ctx context.Context, w io.Writer, fsys fs.FS, opts ...Option) error {
+	xz, err := NewWithOptions(ctx, w, opts...)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(xz)
+	errWalk := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if name == "." || !(d.IsDir() || d.Type().IsRegular()) {
+			return nil
+		}
+
+		return writeTarEntry(tw, fsys, name, d)
+	})
+
+	if errWalk == nil {
+		errWalk = tw.Close()
+	}
+
+	return errors.Join(xz.Close(), errWalk)
+}
+
+// writeTarEntry writes the header of the entry at name and, for a regular
+// file, its contents.
+func writeTarEntry(tw *tar.Writer, fsys fs.FS, name string, d fs.DirEntry) error {
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+
+	hdr.Name = name
+	if d.IsDir() {
+		hdr.Name += "/"
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if d.IsDir() {
+		return nil
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+
+	_, errCopy := io.Copy(tw, f)
+
+	return errors.Join(errCopy, f.Close())
+}
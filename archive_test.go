@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jwkohnen/xzwriter"
+)
+
+func TestCompressFS(t *testing.T) {
+	requireXZ(t)
+
+	fsys := fstest.MapFS{
+		"b.txt":       {Data: []byte("b")},
+		"a/x.txt":     {Data: []byte("x")},
+		"empty":       {Mode: 0o755 | 1<<31},
+		"a/link":      {Data: []byte("b.txt"), Mode: 1 << 27},
+		"a/y/z.txt":   {Data: text(64 << 10)},
+		"a/y/nothing": {},
+	}
+
+	var buf bytes.Buffer
+	if err := xzwriter.CompressFS(context.Background(), &buf, fsys); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(bytes.NewReader(xzDecompress(t, buf.Bytes())))
+
+	var names []string
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names = append(names, hdr.Name)
+
+		if hdr.Typeflag == tar.TypeReg {
+			got, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want := fsys[hdr.Name].Data; !bytes.Equal(got, want) {
+				t.Errorf("%s: got %d bytes, want %d bytes", hdr.Name, len(got), len(want))
+			}
+		}
+	}
+
+	want := []string{"a/", "a/x.txt", "a/y/", "a/y/nothing", "a/y/z.txt", "b.txt", "empty/"}
+	if len(names) != len(want) {
+		t.Fatalf("entries %q, want %q", names, want)
+	}
+
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("entries %q, want %q", names, want)
+		}
+	}
+}
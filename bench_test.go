@@ -0,0 +1,242 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/jwkohnen/xzwriter"
+)
+
+// benchData is the input of the benchmarks, random enough to keep xz busy,
+// but compressible.
+var benchData = func() []byte {
+	b := text(4 << 20)
+	copy(b, random(len(b)/2))
+
+	return b
+}()
+
+func BenchmarkThreads(b *testing.B) {
+	requireXZ(b)
+
+	for _, threads := range []int{1, 2, 4} {
+		b.Run(strconv.Itoa(threads), func(b *testing.B) {
+			b.SetBytes(int64(len(benchData)))
+
+			for i := 0; i < b.N; i++ {
+				compress(b, benchData, xzwriter.WithCompressLevel(1), xzwriter.WithThreads(threads))
+			}
+		})
+	}
+}
+
+// onlyReader hides the WriterTo method of a reader from io.Copy.
+type onlyReader struct{ io.Reader }
+
+// onlyWriter hides the ReaderFrom method of a writer from io.Copy.
+type onlyWriter struct{ io.Writer }
+
+func BenchmarkReadFrom(b *testing.B) {
+	requireXZ(b)
+
+	for name, wrap := range map[string]func(*xzwriter.XZWriter) io.Writer{
+		"ReadFrom": func(xz *xzwriter.XZWriter) io.Writer { return xz },
+		"Write":    func(xz *xzwriter.XZWriter) io.Writer { return onlyWriter{xz} },
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(benchData)))
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithCompressLevel(0))
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if _, err := io.Copy(wrap(xz), onlyReader{bytes.NewReader(benchData)}); err != nil {
+					b.Fatal(err)
+				}
+
+				if err := xz.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkWriteString(b *testing.B) {
+	requireXZ(b)
+
+	s := string(text(1 << 10))
+
+	for name, write := range map[string]func(*xzwriter.XZWriter) error{
+		"WriteString": func(xz *xzwriter.XZWriter) error {
+			_, err := xz.WriteString(s)
+
+			return err
+		},
+		"Write": func(xz *xzwriter.XZWriter) error {
+			_, err := xz.Write([]byte(s))
+
+			return err
+		},
+	} {
+		b.Run(name, func(b *testing.B) {
+			xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithCompressLevel(0))
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.SetBytes(int64(len(s)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := write(xz); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.StopTimer()
+
+			if err := xz.Close(); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func BenchmarkLargeWrite(b *testing.B) {
+	requireXZ(b)
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithCompressLevel(0))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(benchData)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := xz.Write(benchData); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.StopTimer()
+
+	if err := xz.Close(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkOneByteWrites(b *testing.B) {
+	for _, size := range []int{0, xzwriter.DefaultBufferSize} {
+		b.Run("buffer="+strconv.Itoa(size), func(b *testing.B) {
+			xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard,
+				xzwriter.WithCompressLevel(0), xzwriter.WithBufferSize(size))
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			p := []byte{'x'}
+
+			b.SetBytes(1)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := xz.Write(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.StopTimer()
+
+			if err := xz.Close(); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func BenchmarkWriteTo(b *testing.B) {
+	requireXZ(b)
+
+	c := compress(b, benchData, xzwriter.WithCompressLevel(0))
+
+	for name, wrap := range map[string]func(*xzwriter.XZReader) io.Reader{
+		"WriteTo": func(r *xzwriter.XZReader) io.Reader { return r },
+		"Read":    func(r *xzwriter.XZReader) io.Reader { return onlyReader{r} },
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(benchData)))
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				r, err := xzwriter.NewReader(bytes.NewReader(c))
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if _, err := io.Copy(onlyWriter{io.Discard}, wrap(r)); err != nil {
+					b.Fatal(err)
+				}
+
+				if err := r.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCompressFile(b *testing.B) {
+	requireXZ(b)
+
+	dir := b.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "src.xz")
+
+	if err := os.WriteFile(src, benchData, 0o600); err != nil {
+		b.Fatal(err)
+	}
+
+	// WithProgress needs to see the data, so it makes CompressFile stream src
+	// through the pipe.
+	for name, opts := range map[string][]xzwriter.Option{
+		"Path":      {xzwriter.WithCompressLevel(0)},
+		"Streaming": {xzwriter.WithCompressLevel(0), xzwriter.WithProgress(func(int64, int64) {})},
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(benchData)))
+
+			for i := 0; i < b.N; i++ {
+				if err := xzwriter.CompressFile(context.Background(), dst, src, opts...); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
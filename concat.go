@@ -0,0 +1,212 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ConcatWriter compresses its input in chunks, each by an XZWriter of its own,
+// and writes the resulting .xz streams in order to the destination. xz
+// decompresses the concatenation as a whole. Rotate ends a chunk: its stream
+// is finished in the background while the next chunk is written, so the
+// chunks are compressed concurrently.
+//
+// The compressed stream of each chunk is buffered in memory until all streams
+// before it have been written to the destination, so the memory usage grows
+// with the size and the number of the chunks in flight. A ConcatWriter is not
+// safe for concurrent use.
+type ConcatWriter struct {
+	ctx   context.Context
+	w     io.Writer
+	opts  []Option
+	cur   *concatPart   // the chunk being written
+	parts []*concatPart // the chunks being finished, in order
+	err   error         // sticky
+}
+
+// concatPart is a chunk of a ConcatWriter.
+type concatPart struct {
+	buf  bytes.Buffer
+	xz   *XZWriter
+	done chan struct{}
+	err  error // the result of Close, valid once done is closed
+}
+
+// NewConcatWriter returns a ConcatWriter that writes to w, starting the
+// XZWriter of its first chunk. The options are applied to the XZWriter of
+// every chunk like with NewWithOptions. WithHash and WithIndexWriter are not
+// supported, as the chunks would share the hash and the index writer. Neither
+// are WithFormat(FormatLZMA) and WithStoreOnly, whose streams cannot be
+// concatenated.
+func NewConcatWriter(ctx context.Context, w io.Writer, opts ...Option) (*ConcatWriter, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.hash != nil || o.indexWriter != nil {
+		return nil, fmt.Errorf("%w: a concat writer does not support a hash or an index writer", ErrOptionIllegal)
+	}
+
+	if o.format == FormatLZMA || o.storeOnly {
+		return nil, fmt.Errorf("%w: a concat writer requires the %s format", ErrOptionIllegal, FormatXZ)
+	}
+
+	c := &ConcatWriter{ctx: ctx, w: w, opts: opts}
+
+	if err := c.startPart(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Write writes p to the current chunk.
+func (c *ConcatWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	n, err := c.cur.xz.Write(p)
+	if err != nil {
+		c.err = err
+	}
+
+	return n, err
+}
+
+// Rotate ends the current chunk and starts a new one. The stream of the ended
+// chunk is finished in the background and written to the destination once all
+// streams before it have been. Rotate is a no-op if nothing has been written
+// to the current chunk.
+func (c *ConcatWriter) Rotate() error {
+	if c.err != nil {
+		return c.err
+	}
+
+	if in, _ := c.cur.xz.Stats(); in == 0 {
+		return nil
+	}
+
+	c.finishPart()
+
+	if err := c.drain(false); err != nil {
+		return err
+	}
+
+	if err := c.startPart(); err != nil {
+		c.err = err
+
+		return err
+	}
+
+	return nil
+}
+
+// Close ends the current chunk, waits for all streams to be finished and
+// writes them to the destination. It does not close the destination.
+func (c *ConcatWriter) Close() error {
+	if errors.Is(c.err, ErrClosed) {
+		return nil
+	}
+
+	if c.cur != nil {
+		c.finishPart()
+	}
+
+	err := c.err
+	if err == nil {
+		err = c.drain(true)
+	}
+
+	// Reap the processes of the chunks left after a failure.
+	for _, p := range c.parts {
+		<-p.done
+	}
+
+	c.parts = nil
+	c.err = ErrClosed
+
+	return err
+}
+
+func (c *ConcatWriter) startPart() error {
+	p := &concatPart{done: make(chan struct{})}
+
+	xz, err := NewWithOptions(c.ctx, &p.buf, c.opts...)
+	if err != nil {
+		return err
+	}
+
+	p.xz = xz
+	c.cur = p
+
+	return nil
+}
+
+// finishPart closes the XZWriter of the current chunk in the background.
+func (c *ConcatWriter) finishPart() {
+	p := c.cur
+	c.cur = nil
+	c.parts = append(c.parts, p)
+
+	go func() {
+		p.err = p.xz.Close()
+		close(p.done)
+	}()
+}
+
+// drain writes the streams of the finished chunks at the head to the
+// destination, in order. If wait is true, it waits for all chunks to finish.
+func (c *ConcatWriter) drain(wait bool) error {
+	for len(c.parts) > 0 {
+		p := c.parts[0]
+
+		if wait {
+			<-p.done
+		} else {
+			select {
+			case <-p.done:
+			default:
+				return nil
+			}
+		}
+
+		if p.err != nil {
+			c.err = p.err
+
+			return p.err
+		}
+
+		if _, err := c.w.Write(p.buf.Bytes()); err != nil {
+			c.err = err
+
+			return err
+		}
+
+		c.parts = c.parts[1:]
+	}
+
+	return nil
+}
+
+var _ io.WriteCloser = (*ConcatWriter)(nil)
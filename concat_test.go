@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/jwkohnen/xzwriter"
+)
+
+func TestConcatWriter(t *testing.T) {
+	requireXZ(t)
+
+	var buf bytes.Buffer
+
+	c, err := xzwriter.NewConcatWriter(context.Background(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []byte
+
+	for i := 0; i < 5; i++ {
+		// The first Rotate is a no-op, as the chunk is empty.
+		if err := c.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+
+		chunk := text(100<<10 + i)
+		want = append(want, chunk...)
+
+		if _, err := c.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertRoundTrip(t, buf.Bytes(), want)
+
+	if n := bytes.Count(buf.Bytes(), []byte("\xfd7zXZ\x00")); n != 5 {
+		t.Errorf("%d streams, want 5", n)
+	}
+}
+
+func TestConcatWriterRejectsOptions(t *testing.T) {
+	for _, opt := range []xzwriter.Option{
+		xzwriter.WithHash(sha256.New()), xzwriter.WithIndexWriter(io.Discard),
+		xzwriter.WithFormat(xzwriter.FormatLZMA), xzwriter.WithStoreOnly(),
+	} {
+		_, err := xzwriter.NewConcatWriter(context.Background(), io.Discard, opt)
+		if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+			t.Errorf("got %v, want ErrOptionIllegal", err)
+		}
+	}
+}
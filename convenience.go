@@ -0,0 +1,209 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// CompressBytes compresses data in one go. The options are applied like with
+// NewWithOptions.
+func CompressBytes(ctx context.Context, data []byte, opts ...Option) ([]byte, error) {
+	var buf bytes.Buffer
+
+	xz, err := NewWithOptions(ctx, &buf, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	_, errWrite := xz.Write(data)
+	if err := errors.Join(xz.Close(), errWrite); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecompressBytes decompresses data in one go. The options are applied like
+// with NewReaderWithOptions.
+func DecompressBytes(ctx context.Context, data []byte, opts ...Option) ([]byte, error) {
+	xz, err := NewReaderWithOptions(ctx, bytes.NewReader(data), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	out, errRead := io.ReadAll(xz)
+	if err := errors.Join(xz.Close(), errRead); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// Compress compresses src to dst until EOF and returns the number of
+// uncompressed bytes copied. The options are applied like with
+// NewWithOptions.
+func Compress(ctx context.Context, dst io.Writer, src io.Reader, opts ...Option) (written int64, err error) {
+	xz, err := NewWithOptions(ctx, dst, opts...)
+	if err != nil {
+		return 0, err
+	}
+
+	written, errCopy := io.Copy(xz, src)
+
+	return written, errors.Join(xz.Close(), errCopy)
+}
+
+// CompressReader returns a reader of the compressed stream of src, e.g. to
+// pass it as the body of an HTTP request. src is copied to an XZWriter on a
+// goroutine, whose output is piped to the returned reader. Errors, including
+// those of starting xz, are returned by Read. The options are applied like
+// with NewWithOptions.
+//
+// Closing the reader before EOF kills xz. Close waits for the goroutine to
+// finish, so it blocks until a pending Read of src returns.
+func CompressReader(ctx context.Context, src io.Reader, opts ...Option) io.ReadCloser {
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		_, err := Compress(ctx, pw, src, opts...)
+		_ = pw.CloseWithError(err)
+	}()
+
+	return &compressReader{PipeReader: pr, cancel: cancel, done: done}
+}
+
+// compressReader is the reader returned by CompressReader.
+type compressReader struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (r *compressReader) Close() error {
+	r.cancel()
+	err := r.PipeReader.Close()
+	<-r.done
+
+	return err
+}
+
+// Decompress decompresses src to dst until EOF and returns the number of
+// decompressed bytes copied. The options are applied like with
+// NewReaderWithOptions.
+func Decompress(ctx context.Context, dst io.Writer, src io.Reader, opts ...Option) (written int64, err error) {
+	xz, err := NewReaderWithOptions(ctx, src, opts...)
+	if err != nil {
+		return 0, err
+	}
+
+	written, errCopy := io.Copy(dst, xz)
+
+	return written, errors.Join(xz.Close(), errCopy)
+}
+
+// CompressFile compresses the file src to the file dst, which is created or
+// truncated. If anything fails, dst is removed.
+//
+// On Linux, xz is given the path of src to read the file itself, which saves
+// copying the data through a pipe, unless options like WithHash, WithProgress
+// or WithFallback need to see the data, or src is not a regular file. Other
+// platforms always stream src through the pipe.
+func CompressFile(ctx context.Context, dst, src string, opts ...Option) error {
+	return convertFile(dst, src, func(w io.Writer, r io.Reader) error {
+		if runtime.GOOS != "linux" || !isRegularFile(r) {
+			_, err := Compress(ctx, w, r, opts...)
+
+			return err
+		}
+
+		path, err := filepath.Abs(src)
+		if err != nil {
+			return err
+		}
+
+		xz, err := NewWithOptions(ctx, w, append(opts[:len(opts):len(opts)], withInputFile(path))...)
+		if err != nil {
+			return err
+		}
+
+		var errCopy error
+		if !xz.opts.readsInputFile() {
+			_, errCopy = io.Copy(xz, r)
+		}
+
+		return errors.Join(xz.Close(), errCopy)
+	})
+}
+
+// DecompressFile decompresses the file src to the file dst, which is created
+// or truncated. If anything fails, dst is removed.
+func DecompressFile(ctx context.Context, dst, src string, opts ...Option) error {
+	return convertFile(dst, src, func(w io.Writer, r io.Reader) error {
+		_, err := Decompress(ctx, w, r, opts...)
+
+		return err
+	})
+}
+
+// isRegularFile reports whether r is an *os.File of a regular file, which xz
+// can be given by its path. For a directory, e.g., xz would merely warn and
+// skip it.
+func isRegularFile(r io.Reader) bool {
+	f, ok := r.(*os.File)
+	if !ok {
+		return false
+	}
+
+	fi, err := f.Stat()
+
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// convertFile opens src and creates dst for convert, taking care of closing
+// both and removing dst on failure.
+func convertFile(dst, src string, convert func(w io.Writer, r io.Reader) error) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = in.Close() }()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = os.Remove(dst)
+		}
+	}()
+
+	return errors.Join(convert(out, in), out.Close())
+}
@@ -0,0 +1,257 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/jwkohnen/xzwriter"
+)
+
+func TestCompressBytes(t *testing.T) {
+	requireXZ(t)
+
+	for _, data := range [][]byte{nil, {}, []byte("x"), text(1 << 20), random(64 << 10)} {
+		c, err := xzwriter.CompressBytes(context.Background(), data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := xzwriter.DecompressBytes(context.Background(), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, data) {
+			t.Errorf("got %d bytes, want %d bytes", len(got), len(data))
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := xzwriter.CompressBytes(ctx, text(1<<20)); err == nil {
+		t.Error("CompressBytes has ignored the canceled context")
+	}
+
+	if _, err := xzwriter.DecompressBytes(context.Background(), []byte("garbage")); err == nil {
+		t.Error("DecompressBytes has accepted garbage")
+	}
+
+	_, err := xzwriter.CompressBytes(context.Background(), nil, xzwriter.WithCheck("md5"))
+	if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+		t.Errorf("got %v, want ErrOptionIllegal", err)
+	}
+}
+
+func TestCompressAndDecompress(t *testing.T) {
+	requireXZ(t)
+
+	data := text(1 << 20)
+
+	var c bytes.Buffer
+
+	n, err := xzwriter.Compress(context.Background(), &c, bytes.NewReader(data))
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("Compress() = %d, %v", n, err)
+	}
+
+	var d bytes.Buffer
+
+	n, err = xzwriter.Decompress(context.Background(), &d, &c)
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("Decompress() = %d, %v", n, err)
+	}
+
+	if !bytes.Equal(d.Bytes(), data) {
+		t.Error("the data differs")
+	}
+}
+
+func TestCompressFile(t *testing.T) {
+	requireXZ(t)
+
+	dir := t.TempDir()
+	src, dst, back := filepath.Join(dir, "src"), filepath.Join(dir, "src.xz"), filepath.Join(dir, "back")
+	data := text(1 << 20)
+
+	if err := os.WriteFile(src, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// On Linux xz reads src by its path, unless an option needs to see the
+	// data.
+	for name, opts := range map[string][]xzwriter.Option{
+		"path":      nil,
+		"streaming": {xzwriter.WithHash(sha256.New())},
+	} {
+		if err := xzwriter.CompressFile(context.Background(), dst, src, opts...); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if err := xzwriter.DecompressFile(context.Background(), back, dst); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		got, err := os.ReadFile(back)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: the data differs", name)
+		}
+	}
+}
+
+func TestCompressFileFailureRemovesDestination(t *testing.T) {
+	requireXZ(t)
+
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "dst.xz")
+
+	if err := xzwriter.CompressFile(context.Background(), dst, dir); err == nil {
+		t.Error("a directory has been compressed")
+	}
+
+	if err := xzwriter.CompressFile(context.Background(), dst, filepath.Join(dir, "missing")); err == nil {
+		t.Error("a missing file has been compressed")
+	}
+
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xzwriter.CompressFile(context.Background(), dst, src, xzwriter.WithArgs("--no-such-flag")); err == nil {
+		t.Error("xz has not failed")
+	}
+
+	if _, err := os.Stat(dst); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the destination has not been removed: %v", err)
+	}
+}
+
+func TestCompressReader(t *testing.T) {
+	requireXZ(t)
+
+	data := text(1 << 20)
+
+	r := xzwriter.CompressReader(context.Background(), bytes.NewReader(data))
+
+	c, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertRoundTrip(t, c, data)
+}
+
+func TestCompressReaderErrors(t *testing.T) {
+	r := xzwriter.CompressReader(context.Background(), bytes.NewReader(nil), xzwriter.WithBinary("definitely-not-xz"))
+	if _, err := io.ReadAll(r); !errors.Is(err, xzwriter.ErrXZNotFound) {
+		t.Errorf("got %v, want ErrXZNotFound", err)
+	}
+
+	_ = r.Close()
+}
+
+func TestCompressReaderEarlyClose(t *testing.T) {
+	fake := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "cat")
+	}
+
+	r := xzwriter.CompressReader(context.Background(), bytes.NewReader(text(64<<20)), xzwriter.WithCommandFunc(fake))
+
+	if _, err := io.ReadFull(r, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		_ = r.Close()
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close has not returned")
+	}
+}
+
+func TestCompressFileArgs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("xz reads the file by its path only on Linux")
+	}
+
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "src.xz")
+
+	if err := os.WriteFile(src, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The command line ends with the path of a regular file, or with "-" for
+	// STDIN, if an option needs to see the data.
+	for name, tc := range map[string]struct {
+		opts []xzwriter.Option
+		want string
+	}{
+		"regular file": {nil, src},
+		"streaming":    {[]xzwriter.Option{xzwriter.WithProgress(func(int64, int64) {})}, "-"},
+	} {
+		var args []string
+
+		record := func(ctx context.Context, _ string, arg ...string) *exec.Cmd {
+			args = arg
+
+			return exec.CommandContext(ctx, "cat")
+		}
+
+		opts := append([]xzwriter.Option{xzwriter.WithCommandFunc(record)}, tc.opts...)
+		if err := xzwriter.CompressFile(context.Background(), dst, src, opts...); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if n := len(args); n < 2 || args[n-2] != "--" || args[n-1] != tc.want {
+			t.Errorf("%s: args %q do not end with -- %s", name, args, tc.want)
+		}
+
+		for _, arg := range args[:len(args)-1] {
+			if arg == "-" {
+				t.Errorf("%s: args %q name STDIN as well", name, args)
+			}
+		}
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var (
+	// ErrXZNotFound is returned if the xz executable cannot be found.
+	ErrXZNotFound = errors.New("xz executable not found")
+
+	// ErrNotClosed is returned by Reset if the previous stream has not been
+	// closed yet.
+	ErrNotClosed = errors.New("xzwriter: not closed")
+
+	// ErrClosed is returned when writing to an XZWriter that has been closed.
+	ErrClosed = errors.New("xzwriter: closed")
+
+	// ErrNotStarted is returned when using an XZWriter or XZReader that has
+	// not been returned by a constructor.
+	ErrNotStarted = errors.New("xzwriter: not started")
+
+	// ErrMemLimit matches the error of an XZReader whose stream needs more
+	// memory than the limit configured with WithMemLimit.
+	ErrMemLimit = errors.New("xzwriter: memory usage limit reached")
+
+	// ErrOutputTooLarge is returned by an XZReader that would yield more
+	// bytes than configured with WithMaxOutput.
+	ErrOutputTooLarge = errors.New("xzwriter: output too large")
+
+	// ErrQuotaExceeded is returned by an XZWriter whose compressed output
+	// has reached the budget configured with WithMaxCompressed.
+	ErrQuotaExceeded = errors.New("xzwriter: quota exceeded")
+
+	// ErrTruncated matches the error of an XZReader whose compressed input
+	// ended before the end of the stream, e.g. a partial download.
+	ErrTruncated = errors.New("xzwriter: unexpected end of input")
+
+	// ErrCorrupt matches the error of an XZReader whose compressed input is
+	// corrupt, e.g. because of flipped bits.
+	ErrCorrupt = errors.New("xzwriter: compressed data is corrupt")
+
+	// ErrCloseTimeout is returned by Close of an XZWriter whose compressor
+	// process has not exited within the timeout configured with
+	// WithCloseTimeout, and has been killed.
+	ErrCloseTimeout = errors.New("xzwriter: close timed out")
+)
+
+// Exit codes of xz, see XZError.ExitCode.
+const (
+	ExitCodeError   = 1 // an error occurred
+	ExitCodeWarning = 2 // something worth a warning occurred, but no error
+)
+
+// XZError is returned if the external xz process exited unsuccessfully.  It
+// carries what xz wrote to STDERR, which usually explains the failure.
+type XZError struct {
+	// Err is the error returned by waiting on the process, usually an
+	// *exec.ExitError.
+	Err error
+
+	// Stderr holds the (possibly truncated) diagnostic output of xz.
+	Stderr string
+}
+
+func (e *XZError) Error() string {
+	msg := strings.TrimSpace(e.Stderr)
+	if msg == "" {
+		return e.Err.Error()
+	}
+
+	return e.Err.Error() + ": " + msg
+}
+
+// ExitCode returns the exit code of the xz process, which is ExitCodeError or
+// ExitCodeWarning, or -1 if the process has been killed by a signal.
+//
+// Note that on ExitCodeWarning the output is usually still valid, so callers
+// may choose to tolerate it.
+func (e *XZError) ExitCode() int {
+	var exitErr *exec.ExitError
+	if !errors.As(e.Err, &exitErr) {
+		return -1
+	}
+
+	return exitErr.ExitCode()
+}
+
+// Is reports whether target is ErrMemLimit, ErrTruncated or ErrCorrupt and the
+// diagnostics of xz tell so.  Matching the diagnostics requires xz to run in an
+// English or the C locale.
+func (e *XZError) Is(target error) bool {
+	var msg string
+
+	switch target {
+	case ErrMemLimit:
+		msg = "Memory usage limit reached"
+	case ErrTruncated:
+		msg = "Unexpected end of input"
+	case ErrCorrupt:
+		msg = "Compressed data is corrupt"
+	default:
+		return false
+	}
+
+	return strings.Contains(e.Stderr, msg)
+}
+
+// Unwrap returns the underlying error.
+func (e *XZError) Unwrap() error {
+	return e.Err
+}
+
+// wrapExitError attaches the captured diagnostics to err if err reports an
+// unsuccessful exit of the process.  Other errors are returned as is.
+func wrapExitError(err error, stderr *tailBuffer) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+
+	return &XZError{Err: err, Stderr: stderr.String()}
+}
+
+// waitError turns the result of waiting on the process into the error returned
+// by Close. If the context is done, the process has likely been killed because
+// of that, so the error of the context is wrapped, too.
+func waitError(ctx context.Context, err error, stderr *tailBuffer) error {
+	if err == nil {
+		return nil
+	}
+
+	err = wrapExitError(err, stderr)
+
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		return fmt.Errorf("xzwriter: %w: %w", ctxErr, err)
+	}
+
+	return err
+}
+
+// tolerateWarning returns the diagnostics of xz and a nil error, if err
+// reports that xz has exited with ExitCodeWarning.  Other errors are returned
+// as is.
+func tolerateWarning(err error) (warning string, _ error) {
+	var xzErr *XZError
+	if errors.As(err, &xzErr) && xzErr.ExitCode() == ExitCodeWarning {
+		return strings.TrimSpace(xzErr.Stderr), nil
+	}
+
+	return "", err
+}
+
+// startError describes the failure to start the executable binary.
+func startError(binary string, err error) error {
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("xzwriter: %w: %q, please install XZ Utils <https://tukaani.org/xz/>: %v",
+			ErrXZNotFound, binary, err)
+	}
+
+	return fmt.Errorf("xzwriter: cannot start %q: %w", binary, err)
+}
+
+// maxStderr bounds the amount of diagnostics kept in memory.  The verbose
+// progress output of a long running process would otherwise grow without
+// limit.
+const maxStderr = 4 << 10
+
+// tailBuffer is a writer that keeps the last maxStderr bytes written to it.
+type tailBuffer struct {
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > maxStderr {
+		b.buf = b.buf[len(b.buf)-maxStderr:]
+	}
+
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	return string(b.buf)
+}
+
+// isBrokenPipe reports whether xz has failed because the pipe to its STDOUT
+// has been closed, either killed by SIGPIPE or with a write error.
+func isBrokenPipe(err error, stderr *tailBuffer) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+
+	return killedBySIGPIPE(exitErr.ProcessState) || strings.Contains(stderr.String(), "Broken pipe")
+}
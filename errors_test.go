@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jwkohnen/xzwriter"
+)
+
+func TestXZErrorCarriesStderr(t *testing.T) {
+	requireXZ(t)
+
+	r, err := xzwriter.NewReader(strings.NewReader("this is not an .xz stream"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = io.Copy(io.Discard, r)
+
+	err = r.Close()
+
+	var xzErr *xzwriter.XZError
+	if !errors.As(err, &xzErr) {
+		t.Fatalf("got %v, want an *XZError", err)
+	}
+
+	if !strings.Contains(xzErr.Stderr, "format") {
+		t.Errorf("stderr %q does not explain the failure", xzErr.Stderr)
+	}
+
+	if !strings.Contains(err.Error(), strings.TrimSpace(xzErr.Stderr)) {
+		t.Errorf("error %q does not contain stderr", err)
+	}
+}
+
+func TestInvalidOptionReportsStderr(t *testing.T) {
+	requireXZ(t)
+
+	// The option passes validation, but xz rejects the value.
+	xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithThreads(100000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = xz.Write(text(64 << 10))
+
+	err = xz.Close()
+
+	var xzErr *xzwriter.XZError
+	if !errors.As(err, &xzErr) {
+		t.Fatalf("got %v, want an *XZError", err)
+	}
+
+	if !strings.Contains(xzErr.Stderr, "threads") {
+		t.Errorf("stderr %q does not mention the option", xzErr.Stderr)
+	}
+
+	if xzErr.ExitCode() != xzwriter.ExitCodeError {
+		t.Errorf("exit code %d, want %d", xzErr.ExitCode(), xzwriter.ExitCodeError)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	warn := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "sh", "-c", "cat >/dev/null; exit 2")
+	}
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithCommandFunc(warn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var xzErr *xzwriter.XZError
+	if err := xz.Close(); !errors.As(err, &xzErr) || xzErr.ExitCode() != xzwriter.ExitCodeWarning {
+		t.Errorf("got %v, want an *XZError with exit code %d", err, xzwriter.ExitCodeWarning)
+	}
+
+	kill := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "cat")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	xz, err = xzwriter.NewWithOptions(ctx, io.Discard, xzwriter.WithCommandFunc(kill))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	<-xz.Done()
+
+	if err := xz.Close(); !errors.As(err, &xzErr) || xzErr.ExitCode() != -1 {
+		t.Errorf("got %v, want an *XZError with exit code -1", err)
+	}
+}
+
+func TestBinaryNotFound(t *testing.T) {
+	_, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithBinary("definitely-not-xz"))
+	if !errors.Is(err, xzwriter.ErrXZNotFound) {
+		t.Errorf("writer: got %v, want ErrXZNotFound", err)
+	}
+
+	_, err = xzwriter.NewReaderWithOptions(context.Background(), nil, xzwriter.WithBinary("definitely-not-xz"))
+	if !errors.Is(err, xzwriter.ErrXZNotFound) {
+		t.Errorf("reader: got %v, want ErrXZNotFound", err)
+	}
+
+	_, err = xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithBinary("/definitely/not/xz"))
+	if !errors.Is(err, xzwriter.ErrXZNotFound) {
+		t.Errorf("path: got %v, want ErrXZNotFound", err)
+	}
+}
+
+func TestPipeDeathReportsCause(t *testing.T) {
+	die := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "sh", "-c", "echo 'xz: out of luck' >&2; exit 1")
+	}
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard,
+		xzwriter.WithCommandFunc(die), xzwriter.WithBufferSize(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-xz.Done()
+
+	// The broken pipe is explained by the error of the process.
+	_, err = xz.Write(text(1 << 20))
+
+	var xzErr *xzwriter.XZError
+	if !errors.As(err, &xzErr) || xzErr.ExitCode() != xzwriter.ExitCodeError {
+		t.Fatalf("got %v, want an *XZError with exit code %d", err, xzwriter.ExitCodeError)
+	}
+
+	if !errors.Is(err, syscall.EPIPE) || !strings.Contains(err.Error(), "out of luck") {
+		t.Errorf("got %v, want the broken pipe and the diagnostics of the process", err)
+	}
+
+	_ = xz.Close()
+}
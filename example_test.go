@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter_test
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/jwkohnen/xzwriter"
+)
+
+// XZWriter and XZReader are used like the writers and readers of
+// compress/gzip.
+func Example() {
+	dir, err := os.MkdirTemp("", "xzwriter-example")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "hello.txt.xz")
+
+	f, err := os.Create(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w, err := xzwriter.New(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := io.WriteString(w, "Hello, xz!\n"); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	f, err = os.Open(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := xzwriter.NewReader(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := r.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Print(string(data))
+	// Output: Hello, xz!
+}
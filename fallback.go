@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// fallbackDictCap maps the compression levels to the dictionary sizes of the
+// corresponding xz presets.
+var fallbackDictCap = [...]int{
+	256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20,
+}
+
+// useFallback reports whether the in-process compressor is used instead of
+// the compressor process.
+func (xz *XZWriter) useFallback() bool {
+	if !xz.opts.fallback {
+		return false
+	}
+
+	_, err := exec.LookPath(xz.opts.binary)
+
+	return err != nil
+}
+
+// startFallback starts the in-process compressor, reading from stdin, in its
+// own goroutine. The goroutine closes stdin when done, so that writes to the
+// other end of the pipe fail instead of blocking if the compressor fails.
+func (xz *XZWriter) startFallback(stdin *os.File) error {
+	enc, err := newFallbackEncoder(&xz.opts, xz.out)
+	if err != nil {
+		_ = stdin.Close()
+
+		return err
+	}
+
+	xz.cmd = nil
+	xz.proc = &process{done: make(chan struct{}), start: time.Now()}
+	proc := xz.proc
+
+	go func() {
+		_, errCopy := io.Copy(enc, stdin)
+		proc.err = errors.Join(errCopy, enc.Close())
+		_ = stdin.Close()
+		proc.end = time.Now()
+		close(proc.done)
+	}()
+
+	return nil
+}
+
+func newFallbackEncoder(o *options, w io.Writer) (io.WriteCloser, error) {
+	dictCap := fallbackDictCap[o.compressLevel]
+	if o.dictSize != 0 {
+		dictCap = int(o.dictSize)
+	}
+
+	if o.format == FormatLZMA {
+		return lzma.WriterConfig{DictCap: dictCap}.NewWriter(w)
+	}
+
+	c := xz.WriterConfig{DictCap: dictCap}
+
+	switch o.check {
+	case CheckNone:
+		c.NoCheckSum = true
+	case CheckCRC32:
+		c.CheckSum = xz.CRC32
+	case CheckSHA256:
+		c.CheckSum = xz.SHA256
+	}
+
+	return c.NewWriter(w)
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/jwkohnen/xzwriter"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+func TestFallback(t *testing.T) {
+	data := text(1 << 20)
+
+	for _, tc := range []struct {
+		format xzwriter.Format
+		opts   []xzwriter.Option
+	}{
+		{xzwriter.FormatXZ, []xzwriter.Option{xzwriter.WithCheck(xzwriter.CheckSHA256)}},
+		{xzwriter.FormatLZMA, nil},
+	} {
+		var buf bytes.Buffer
+
+		opts := append([]xzwriter.Option{
+			xzwriter.WithFallback(), xzwriter.WithBinary("definitely-not-xz"), xzwriter.WithFormat(tc.format),
+		}, tc.opts...)
+
+		xz, err := xzwriter.NewWithOptions(context.Background(), &buf, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !xz.UsedFallback() || xz.Args() != nil || xz.PID() != -1 {
+			t.Errorf("%s: UsedFallback() = %v, Args() = %q, PID() = %d",
+				tc.format, xz.UsedFallback(), xz.Args(), xz.PID())
+		}
+
+		if _, err := xz.Write(data); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := xz.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := fallbackDecompress(t, tc.format, buf.Bytes()); !bytes.Equal(got, data) {
+			t.Errorf("%s: the round trip has changed the data", tc.format)
+		}
+
+		if in, out := xz.Stats(); in != int64(len(data)) || out != int64(buf.Len()) {
+			t.Errorf("%s: Stats() = %d, %d", tc.format, in, out)
+		}
+	}
+
+	requireXZ(t)
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithFallback())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if xz.UsedFallback() || xz.PID() == -1 {
+		t.Error("the fallback is used although xz is installed")
+	}
+
+	_ = xz.Close()
+}
+
+// fallbackDecompress decompresses data with the Go implementation the
+// fallback is built on, so that the test does not depend on xz.
+func fallbackDecompress(t *testing.T, format xzwriter.Format, data []byte) []byte {
+	t.Helper()
+
+	var (
+		r   io.Reader
+		err error
+	)
+
+	if format == xzwriter.FormatLZMA {
+		r, err = lzma.NewReader(bytes.NewReader(data))
+	} else {
+		r, err = xz.NewReader(bytes.NewReader(data))
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return got
+}
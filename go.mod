@@ -1,3 +1,5 @@
 module github.com/jwkohnen/xzwriter
 
-go 1.14
+go 1.20
+
+require github.com/ulikunitz/xz v0.5.17
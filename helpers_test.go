@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter_test
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jwkohnen/xzwriter"
+)
+
+// requireXZ skips the test if the xz executable is not installed.
+func requireXZ(t testing.TB) {
+	t.Helper()
+
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("xz is not installed")
+	}
+}
+
+// text returns n bytes of compressible text.
+func text(n int) []byte {
+	line := []byte("The quick brown fox jumps over the lazy dog. 0123456789\n")
+
+	return bytes.Repeat(line, n/len(line)+1)[:n]
+}
+
+// random returns n bytes of incompressible data.
+func random(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+
+	return b
+}
+
+// compress compresses data with the options and fails the test on error.
+func compress(t testing.TB, data []byte, opts ...xzwriter.Option) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), &buf, opts...)
+	if err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+
+	if _, err := xz.Write(data); err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+// xzDecompress decompresses data with the xz executable, independent of the
+// code under test.
+func xzDecompress(t testing.TB, data []byte, args ...string) []byte {
+	t.Helper()
+
+	var stderr bytes.Buffer
+
+	cmd := exec.Command("xz", append([]string{"--decompress", "--stdout"}, args...)...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("xz --decompress: %v: %s", err, stderr.String())
+	}
+
+	return out
+}
+
+// assertRoundTrip asserts that compressed decompresses to want with the xz
+// executable.
+func assertRoundTrip(t testing.TB, compressed, want []byte, args ...string) {
+	t.Helper()
+
+	if got := xzDecompress(t, compressed, args...); !bytes.Equal(got, want) {
+		t.Fatalf("decompressed %d bytes, want %d bytes", len(got), len(want))
+	}
+}
+
+// listBlock is a block line of `xz --list --robot --verbose`.
+type listBlock struct {
+	compressedOffset, uncompressedOffset, totalSize, uncompressedSize int64
+	check                                                             string
+}
+
+// xzList lists the blocks of a file with `xz --list --robot --verbose`.
+func xzList(t testing.TB, name string) []listBlock {
+	t.Helper()
+
+	out, err := exec.Command("xz", "--list", "--robot", "--verbose", name).Output()
+	if err != nil {
+		t.Fatalf("xz --list: %v", err)
+	}
+
+	var blocks []listBlock
+
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Split(line, "\t")
+		if f[0] != "block" {
+			continue
+		}
+
+		n := func(i int) int64 {
+			v, err := strconv.ParseInt(f[i], 10, 64)
+			if err != nil {
+				t.Fatalf("xz --list: field %d of %q: %v", i, line, err)
+			}
+
+			return v
+		}
+
+		blocks = append(blocks, listBlock{n(4), n(5), n(6), n(7), f[9]})
+	}
+
+	return blocks
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// Index describes the blocks of an .xz stream, as written by WithIndexWriter.
+type Index struct {
+	// CompressedSize is the size of the whole stream.
+	CompressedSize int64 `json:"compressedSize"`
+
+	// UncompressedSize is the size of the data in the stream.
+	UncompressedSize int64 `json:"uncompressedSize"`
+
+	Blocks []IndexBlock `json:"blocks"`
+}
+
+// IndexBlock describes a block of an .xz stream. Offsets are relative to the
+// start of the stream. A decompressor can start at the block at Offset,
+// which begins with the block header, to get the data at UncompressedOffset
+// without decompressing the blocks before it.
+type IndexBlock struct {
+	Offset             int64 `json:"offset"`
+	CompressedSize     int64 `json:"compressedSize"` // header, data, padding and check, like xz --list
+	UncompressedOffset int64 `json:"uncompressedOffset"`
+	UncompressedSize   int64 `json:"uncompressedSize"`
+}
+
+// The number of bytes at the end of the stream that are kept for parsing the
+// index. The large tail, used for WithIndexWriter, fits the index of about
+// 100,000 blocks, the small one, used for WithBlockCount otherwise, about 5,000.
+const (
+	smallIndexTail = 32 << 10
+	largeIndexTail = 1 << 20
+)
+
+const (
+	streamHeaderSize = 12
+	streamFooterSize = 12
+)
+
+var errIndex = errors.New("xzwriter: cannot parse the index of the stream")
+
+// indexTail keeps the last max bytes written to it, or some more. Unlike
+// tailBuffer, it trims rarely, as it sees all of the compressed output.
+type indexTail struct {
+	buf []byte
+	max int
+}
+
+func (t *indexTail) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+
+	if len(t.buf) > 2*t.max {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-t.max:]...)
+	}
+
+	return len(p), nil
+}
+
+// parseIndex parses the index at the end of the stream of size streamSize, of
+// which tail holds the last bytes.
+func parseIndex(tail []byte, streamSize int64) (Index, error) {
+	if len(tail) < streamFooterSize || !bytes.Equal(tail[len(tail)-2:], []byte("YZ")) {
+		return Index{}, errIndex
+	}
+
+	footer := tail[len(tail)-streamFooterSize:]
+	if crc32.ChecksumIEEE(footer[4:10]) != binary.LittleEndian.Uint32(footer) {
+		return Index{}, errIndex
+	}
+
+	indexSize := (int64(binary.LittleEndian.Uint32(footer[4:])) + 1) * 4
+	if indexSize > int64(len(tail)-streamFooterSize) {
+		return Index{}, errIndex
+	}
+
+	index := tail[len(tail)-streamFooterSize-int(indexSize) : len(tail)-streamFooterSize]
+	if index[0] != 0 || crc32.ChecksumIEEE(index[:len(index)-4]) != binary.LittleEndian.Uint32(index[len(index)-4:]) {
+		return Index{}, errIndex
+	}
+
+	r := bytes.NewReader(index[1 : len(index)-4])
+
+	records, err := binary.ReadUvarint(r)
+	if err != nil || records > uint64(len(index)) {
+		return Index{}, errIndex
+	}
+
+	idx := Index{CompressedSize: streamSize, Blocks: make([]IndexBlock, 0, records)}
+	offset := int64(streamHeaderSize)
+
+	for i := uint64(0); i < records; i++ {
+		unpadded, err1 := binary.ReadUvarint(r)
+		uncompressed, err2 := binary.ReadUvarint(r)
+
+		if err1 != nil || err2 != nil {
+			return Index{}, errIndex
+		}
+
+		size := (int64(unpadded) + 3) &^ 3
+
+		idx.Blocks = append(idx.Blocks, IndexBlock{
+			Offset:             offset,
+			CompressedSize:     size,
+			UncompressedOffset: idx.UncompressedSize,
+			UncompressedSize:   int64(uncompressed),
+		})
+
+		offset += size
+		idx.UncompressedSize += int64(uncompressed)
+	}
+
+	if offset+indexSize+streamFooterSize != streamSize {
+		return Index{}, errIndex
+	}
+
+	return idx, nil
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jwkohnen/xzwriter"
+)
+
+func TestIndexWriter(t *testing.T) {
+	requireXZ(t)
+
+	var out, idx bytes.Buffer
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), &out,
+		xzwriter.WithBlockSize(256<<10), xzwriter.WithIndexWriter(&idx))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := random(1<<20 + 1000)
+	if _, err := xz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(t.TempDir(), "data.xz")
+	if err := os.WriteFile(name, out.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var index xzwriter.Index
+	if err := json.Unmarshal(idx.Bytes(), &index); err != nil {
+		t.Fatalf("index: %v", err)
+	}
+
+	if index.CompressedSize != int64(out.Len()) || index.UncompressedSize != int64(len(data)) {
+		t.Errorf("index sizes %d, %d, want %d, %d", index.CompressedSize, index.UncompressedSize, out.Len(), len(data))
+	}
+
+	list := xzList(t, name)
+	if len(index.Blocks) != len(list) || len(list) != 5 {
+		t.Fatalf("%d blocks, xz --list reports %d", len(index.Blocks), len(list))
+	}
+
+	for i, b := range index.Blocks {
+		l := list[i]
+		if b.Offset != l.compressedOffset || b.CompressedSize != l.totalSize ||
+			b.UncompressedOffset != l.uncompressedOffset || b.UncompressedSize != l.uncompressedSize {
+			t.Errorf("block %d: %+v, xz --list reports %+v", i, b, l)
+		}
+	}
+
+	if xz.BlockCount() != len(list) {
+		t.Errorf("BlockCount() = %d, want %d", xz.BlockCount(), len(list))
+	}
+}
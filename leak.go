@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// activateLeakCheck sets a finalizer on xz that reports to the configured leak
+// handler, where xz was created, kills and reaps the compressor process and
+// releases the derived context, if any.
+func activateLeakCheck(xz *XZWriter) {
+	handler, cancel, proc, pipe := xz.opts.leakHandler, xz.cancel, xz.proc, xz.pipe
+
+	var createdAt string
+	if handler != nil {
+		createdAt = callerOutsidePackage()
+	}
+
+	runtime.SetFinalizer(xz, func(*XZWriter) {
+		if handler != nil {
+			handler(createdAt)
+		}
+
+		// The process goroutine reaps the process, so there is no need to
+		// block the finalizer goroutine by waiting for it.
+		_ = pipe.Close()
+		if proc.cmd != nil && !proc.exited() {
+			_ = proc.cmd.Process.Kill()
+		}
+
+		if cancel != nil {
+			cancel()
+		}
+	})
+}
+
+// deactivateLeakCheck removes the finalizer set by activateLeakCheck, if any.
+func deactivateLeakCheck(xz *XZWriter) {
+	runtime.SetFinalizer(xz, nil)
+}
+
+const packagePrefix = "github.com/jwkohnen/xzwriter."
+
+// maxLeakFrames is the number of frames callerOutsidePackage reports.
+const maxLeakFrames = 8
+
+// callerOutsidePackage returns a stack trace of the code calling the
+// constructor, trimmed to maxLeakFrames frames that are neither functions of
+// this package nor of the runtime, e.g. runtime.main and runtime.goexit.
+func callerOutsidePackage() string {
+	pc := make([]uintptr, 64)
+	n := runtime.Callers(2, pc)
+	frames := runtime.CallersFrames(pc[:n])
+
+	var b strings.Builder
+
+	for reported := 0; reported < maxLeakFrames; {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, packagePrefix) && !strings.HasPrefix(frame.Function, "runtime.") {
+			if reported > 0 {
+				b.WriteByte('\n')
+			}
+
+			fmt.Fprintf(&b, "%s\n\t%s:%d", frame.Function, frame.File, frame.Line)
+			reported++
+		}
+
+		if !more {
+			break
+		}
+	}
+
+	if b.Len() == 0 {
+		return "unknown"
+	}
+
+	return b.String()
+}
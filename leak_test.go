@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter_test
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jwkohnen/xzwriter"
+)
+
+func TestLeakHandler(t *testing.T) {
+	requireXZ(t)
+
+	leaks := make(chan string, 1)
+	leakWriter(t, xzwriter.WithLeakHandler(func(createdAt string) { leaks <- createdAt }))
+
+	createdAt := awaitLeak(leaks)
+	if createdAt == "" {
+		t.Fatal("the leak handler has not been called")
+	}
+
+	// The innermost frame is leakWriter, and the runtime is left out.
+	frames := strings.Split(createdAt, "\n")
+	if !strings.HasSuffix(frames[0], ".leakWriter") || len(frames) < 2 || !strings.Contains(frames[1], "leak_test.go:") {
+		t.Errorf("createdAt does not start with leakWriter:\n%s", createdAt)
+	}
+
+	if len(frames) > 16 {
+		t.Errorf("%d lines, want at most 8 frames", len(frames))
+	}
+
+	if strings.Contains(createdAt, "runtime.") {
+		t.Errorf("createdAt reports the runtime:\n%s", createdAt)
+	}
+}
+
+// leakWriter creates an XZWriter and drops it without closing it. It returns
+// the process ID of the compressor process.
+//
+//go:noinline
+func leakWriter(t *testing.T, opts ...xzwriter.Option) int {
+	t.Helper()
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return xz.PID()
+}
+
+// awaitLeak collects garbage until the leak handler reports to leaks, or
+// returns the empty string after a while.
+func awaitLeak(leaks <-chan string) string {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		runtime.GC()
+
+		select {
+		case createdAt := <-leaks:
+			return createdAt
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	return ""
+}
+
+func TestClosedWriterIsNotReported(t *testing.T) {
+	requireXZ(t)
+
+	leaks := make(chan string, 1)
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard,
+		xzwriter.WithLeakHandler(func(createdAt string) { leaks <- createdAt }))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		runtime.GC()
+	}
+
+	select {
+	case createdAt := <-leaks:
+		t.Errorf("a closed writer has been reported as created at %s", createdAt)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
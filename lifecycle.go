@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter
+
+import (
+	"os/exec"
+	"time"
+)
+
+// EventKind is the kind of a LifecycleEvent.
+type EventKind int
+
+// Kinds of LifecycleEvent.
+const (
+	EventStarted EventKind = iota // the process has been started
+	EventExited                   // the process has exited by itself, successfully or not
+	EventKilled                   // the process has been terminated by a signal
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventStarted:
+		return "started"
+	case EventExited:
+		return "exited"
+	case EventKilled:
+		return "killed"
+	default:
+		return "unknown"
+	}
+}
+
+// LifecycleEvent describes a change of state of an xz subprocess, see
+// WithLogger.
+type LifecycleEvent struct {
+	Kind EventKind
+
+	// PID is the process ID of the subprocess.
+	PID int
+
+	// Start is the time the subprocess has been started.
+	Start time.Time
+
+	// Duration is the run time of the subprocess, which is zero for
+	// EventStarted.
+	Duration time.Duration
+
+	// ExitCode is the exit code of the subprocess, or -1 unless Kind is
+	// EventExited.
+	ExitCode int
+}
+
+// logStarted reports the start of cmd to the logger, if any.
+func logStarted(logger func(LifecycleEvent), cmd *exec.Cmd, start time.Time) {
+	if logger == nil {
+		return
+	}
+
+	logger(LifecycleEvent{Kind: EventStarted, PID: cmd.Process.Pid, Start: start, ExitCode: -1})
+}
+
+// logExited reports the exit of cmd to the logger, if any.  It must be called
+// after cmd has been waited for.
+func logExited(logger func(LifecycleEvent), cmd *exec.Cmd, start time.Time) {
+	if logger == nil || cmd.ProcessState == nil {
+		return
+	}
+
+	e := LifecycleEvent{
+		Kind:     EventExited,
+		PID:      cmd.Process.Pid,
+		Start:    start,
+		Duration: time.Since(start),
+		ExitCode: cmd.ProcessState.ExitCode(),
+	}
+
+	// ExitCode is -1 if the process has been terminated by a signal.
+	if e.ExitCode == -1 {
+		e.Kind = EventKilled
+	}
+
+	logger(e)
+}
@@ -0,0 +1,42 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter_test
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// TestMain leaves out the examples if there is no xz executable to run.  An
+// example cannot skip itself the way a test calls requireXZ, so it would fail
+// with wrong output instead.  A pattern given with -run is left alone.
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	if _, err := exec.LookPath("xz"); err != nil && flag.Lookup("test.run").Value.String() == "" {
+		fmt.Println("xz is not installed, skipping the examples")
+
+		if err := flag.Set("test.run", "^Test"); err != nil {
+			panic(err)
+		}
+	}
+
+	os.Exit(m.Run())
+}
@@ -1,40 +1,81 @@
 package xzwriter
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
-type Option func(*XZWriter) error
+// Option configures the external compressor process.  Options are applied in order by NewWithOptions, so a later
+// option overrides an earlier one of the same kind.
+type Option func(*options) error
 
 var (
+	// ErrOptionIllegal is returned by NewWithOptions if an option was given an illegal value.
 	ErrOptionIllegal = errors.New("option illegal")
 )
 
+// Compression levels accepted by WithCompressLevel.  Any level in between `Fast` and `Best` is valid, too.
+// `LevelBestSpeed` and `LevelBestCompression` are aliases named in the spirit of compress/flate.
 const (
-	Fast    = 0
-	Default = 6
-	Best    = 9
+	Fast    = 0 // same as `xz --fast`, i.e. `-0`
+	Default = 6 // same as `xz --default`, i.e. `-6`; used if no level is configured
+	Best    = 9 // same as `xz --best`, i.e. `-9`
+
+	LevelBestSpeed       = Fast
+	LevelBestCompression = Best
 )
 
 // WithCompressLevel sets the compression level between 0 and 9.  The constants `Fast`, `Default` and `Best` correspond
 // to the flags `--fast`, `--default` and `--best`.
 func WithCompressLevel(l int) Option {
-	return func(xz *XZWriter) error {
+	return func(o *options) error {
 		if l < Fast || l > Best {
 			return ErrOptionIllegal
 		}
 
-		xz.opts.compressLevel = l
+		o.compressLevel = l
+		o.levelSet = true
 
 		return nil
 	}
 }
 
-// WithExtreme set the `--extreme` flag.
-func WithExtreme() Option {
-	return func(xz *XZWriter) error {
-		xz.opts.extreme = true
+// WithExtreme sets the `--extreme` flag if extreme is true, which is independent of the compression level: combined
+// with WithCompressLevel(Best) it is the same as `xz -9e`.  It improves the compression ratio a little at the cost of a
+// considerably slower compression; memory usage and decompression speed are not affected.  Taking a bool allows passing
+// a configuration value through; WithExtreme(false) is the default.
+func WithExtreme(extreme bool) Option {
+	return func(o *options) error {
+		o.extreme = extreme
+		o.levelSet = true
+
+		return nil
+	}
+}
+
+// WithPreset sets the compression level and the `--extreme` flag from a preset like on the xz command line, e.g. "6",
+// "9e" or "-9e".  It is meant for passing through configuration values verbatim and cannot be combined with
+// WithCompressLevel or WithExtreme.
+func WithPreset(preset string) Option {
+	return func(o *options) error {
+		p := strings.TrimPrefix(preset, "-")
+		if len(p) < 1 || len(p) > 2 || p[0] < '0' || p[0] > '9' || (len(p) == 2 && p[1] != 'e') {
+			return fmt.Errorf("%w: preset %q is not a digit 0-9, optionally followed by e", ErrOptionIllegal, preset)
+		}
+
+		o.compressLevel = int(p[0] - '0')
+		o.extreme = len(p) == 2
+		o.preset = preset
 
 		return nil
 	}
@@ -43,16 +84,974 @@ func WithExtreme() Option {
 // WithVerbose sets verbosity and takes a writer that will be connected to STDERR of the xz subprocess.  This provides
 // a nice progress output to look at.
 func WithVerbose(stderr io.Writer) Option {
-	return func(xz *XZWriter) error {
-		xz.opts.verboseWriter = stderr
+	return func(o *options) error {
+		o.verboseWriter = stderr
+
+		return nil
+	}
+}
+
+// WithStderr tees STDERR of the xz subprocess to w, e.g. to stream the warnings of xz to a logger as they happen.
+// Unlike WithVerbose, it does not make xz more verbose; note that xz suppresses warnings by `--quiet` unless
+// WithTolerateWarnings or WithVerbose is used.  The diagnostics are still captured for the errors returned by Close.
+// The writer is used by the goroutine that reads STDERR, so a slow writer slows down xz.
+func WithStderr(w io.Writer) Option {
+	return func(o *options) error {
+		o.stderrWriter = w
+
+		return nil
+	}
+}
+
+// WithThreads sets the number of worker threads, i.e. `--threads=n`.  Zero means to use as many threads as
+// runtime.GOMAXPROCS(0) reports at the time the process is started, so that xz honors the CPU quota of the Go program,
+// e.g. one set by the GOMAXPROCS environment variable or a container limit.  Use WithXZThreadDetection to let xz count
+// the CPU cores itself instead.  In multi-threaded mode xz splits the input into blocks, the output is still a single
+// valid .xz stream, but the compression ratio may be slightly worse and the memory usage considerably higher.
+//
+// For XZReader it sets the number of decompression threads, which requires XZ Utils 5.4 or later.  Only streams that
+// have been split into blocks, e.g. by multi-threaded compression or WithBlockSize, can be decompressed in parallel;
+// xz decompresses other streams using a single thread.
+func WithThreads(n int) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return ErrOptionIllegal
+		}
+
+		o.threads = n
+		o.threadsSet = true
+
+		return nil
+	}
+}
+
+// WithBinary sets the name or path of the executable to run instead of `xz`.  A name without path separators is looked
+// up in $PATH.  The executable must understand the command line flags of the Tukaani XZ tool.  WithBinary takes
+// precedence over the environment variable `XZWRITER_BINARY`.
+func WithBinary(path string) Option {
+	return func(o *options) error {
+		if path == "" {
+			return ErrOptionIllegal
+		}
+
+		o.binary = path
+
+		return nil
+	}
+}
+
+// WithFlushTimeout sets `--flush-timeout`: if at least d has passed since the last flush and reading more input would
+// block, xz flushes all pending data to its output.  This makes data written to the XZWriter show up at the destination
+// shortly after a call to Flush, at the price of a worse compression ratio, as every flush ends an LZMA2 chunk.
+// The timeout is truncated to milliseconds and must be at least one millisecond.
+func WithFlushTimeout(d time.Duration) Option {
+	return func(o *options) error {
+		if d < time.Millisecond {
+			return ErrOptionIllegal
+		}
+
+		o.flushTimeout = d
+
+		return nil
+	}
+}
+
+// WithProgress sets a callback that is invoked with the number of uncompressed and compressed bytes processed so far,
+// once about every MiB written and a last time when Close is done.  The callback runs on the goroutine that calls
+// Write or Close, so it should return quickly.  A nil callback is ignored.
+func WithProgress(fn func(bytesIn, bytesOut int64)) Option {
+	return func(o *options) error {
+		o.progress = fn
+
+		return nil
+	}
+}
+
+// MinMemLimit is the smallest memory limit accepted by WithMemLimit.  Even the fastest preset needs more than that.
+const MinMemLimit = 1 << 20
+
+// WithMemLimit sets `--memlimit-compress` to the given number of bytes.  If the configured compression settings would
+// exceed the limit, xz scales down the dictionary size until they fit, so the effective compression is worse than the
+// configured level suggests.  If even that doesn't suffice, xz fails.  Limits below MinMemLimit are illegal.
+//
+// For XZReader it sets `--memlimit-decompress` instead, so xz refuses streams that would need more memory to
+// decompress, such as decompression bombs with huge dictionaries; the error returned by Close then matches ErrMemLimit.
+func WithMemLimit(bytes uint64) Option {
+	return func(o *options) error {
+		if bytes < MinMemLimit {
+			return ErrOptionIllegal
+		}
+
+		o.memLimit = bytes
+
+		return nil
+	}
+}
+
+// WithStrictMemory sets `--no-adjust`: if the compression settings exceed the limit configured with WithMemLimit, xz
+// fails instead of scaling down the number of threads and the dictionary size.  The error returned by Close is then an
+// *XZError that carries the diagnostics of xz.
+func WithStrictMemory() Option {
+	return func(o *options) error {
+		o.strictMemory = true
+
+		return nil
+	}
+}
+
+// CheckType is the type of integrity check stored in the .xz stream.
+type CheckType string
+
+// Integrity checks accepted by WithCheck.  If none is configured, xz uses `CheckCRC64`.
+const (
+	CheckNone   CheckType = "none"
+	CheckCRC32  CheckType = "crc32"
+	CheckCRC64  CheckType = "crc64"
+	CheckSHA256 CheckType = "sha256"
+)
+
+// WithCheck sets the integrity check, i.e. `--check`.  `CheckNone` saves a few bytes and cycles, but then corrupt
+// data may go unnoticed on decompression.
+func WithCheck(check CheckType) Option {
+	return func(o *options) error {
+		switch check {
+		case CheckNone, CheckCRC32, CheckCRC64, CheckSHA256:
+		default:
+			return ErrOptionIllegal
+		}
+
+		o.check = check
+
+		return nil
+	}
+}
+
+// WithLeakHandler arms a check for XZWriters that are garbage collected without having been closed.  The xz process of
+// a leaked XZWriter is killed regardless of this option.  The handler is called with a short stack trace of the code
+// that created the leaked XZWriter: up to eight frames outside of this package and the runtime, innermost first, each
+// as the function name followed by a line with a tab and the file and line.  It runs on the finalizer goroutine, so
+// it must not block for long; it is meant for logging.  It is ignored by XZReader.
+func WithLeakHandler(handler func(createdAt string)) Option {
+	return func(o *options) error {
+		o.leakHandler = handler
+
+		return nil
+	}
+}
+
+// Format is the container format of the compressed stream.
+type Format string
+
+// Container formats accepted by WithFormat.
+const (
+	FormatXZ   Format = "xz"   // the .xz format, the default of XZWriter
+	FormatLZMA Format = "lzma" // the legacy .lzma format, which supports neither integrity checks nor multi-threading
+	FormatAuto Format = "auto" // detect the format when decompressing, the default of XZReader
+)
+
+// FormatGzip is reported by NewAdaptive if it has fallen back to gzip.  WithFormat does not accept it.
+const FormatGzip Format = "gzip"
+
+// formatRaw is the raw format without any container, used by WithStoreOnly.
+const formatRaw Format = "raw"
+
+// storeOnlyFilter is the cheapest LZMA2 configuration, see WithStoreOnly.  LZMA2 stores chunks that do not compress
+// as they are.
+const storeOnlyFilter = "--lzma2=preset=0,dict=4KiB,mf=hc3,nice=3,depth=1"
+
+// WithFormat sets the container format, i.e. `--format`.  XZReader detects the format by default, so this option forces
+// it to accept only the given one.  FormatAuto is illegal for XZWriter.
+func WithFormat(f Format) Option {
+	return func(o *options) error {
+		switch f {
+		case FormatXZ, FormatLZMA, FormatAuto:
+		default:
+			return ErrOptionIllegal
+		}
+
+		o.format = f
+
+		return nil
+	}
+}
+
+// WithNice sets the scheduling priority of the xz subprocess like `nice -n`, from -20 (highest priority) to 19 (lowest
+// priority).  Raising the priority above the one of the calling process usually requires privileges.  The priority is
+// applied right after the process has been started.  On other platforms than Linux and Darwin this option is a no-op.
+func WithNice(n int) Option {
+	return func(o *options) error {
+		if n < -20 || n > 19 {
+			return ErrOptionIllegal
+		}
+
+		o.nice = n
+		o.niceSet = true
+
+		return nil
+	}
+}
+
+// WithArgs appends raw command line arguments, e.g. `--block-size=1MiB`, after the ones derived from other options.
+// Repeated use accumulates the arguments.  The caller is responsible for their correctness; arguments that conflict
+// with other options may override them or make xz fail.
+func WithArgs(args ...string) Option {
+	return func(o *options) error {
+		o.extraArgs = append(o.extraArgs, args...)
+
+		return nil
+	}
+}
+
+// CommandFunc creates the command for the xz subprocess.  exec.CommandContext is the default.
+type CommandFunc func(ctx context.Context, name string, arg ...string) *exec.Cmd
+
+// WithCommandFunc replaces the function that creates the command of the xz subprocess.  This is meant for tests of
+// code that uses this package, which can substitute a fake process without a real xz, e.g.:
+//
+//	xzwriter.WithCommandFunc(func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+//		return exec.CommandContext(ctx, "cat")
+//	})
+//
+// The returned command must not have been started, its standard streams are set up by this package.
+func WithCommandFunc(fn CommandFunc) Option {
+	return func(o *options) error {
+		if fn == nil {
+			return ErrOptionIllegal
+		}
+
+		o.commandFunc = fn
+
+		return nil
+	}
+}
+
+// DefaultBufferSize is the size of the write buffer, unless configured with WithBufferSize.
+const DefaultBufferSize = 64 << 10
+
+// WithBufferSize sets the size of the buffer in front of the pipe to the xz subprocess.  Buffering saves system calls
+// when writing in small pieces.  Zero disables buffering.
+func WithBufferSize(n int) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return ErrOptionIllegal
+		}
+
+		o.bufferSize = n
+
+		return nil
+	}
+}
+
+// WithDeltaFilter puts a delta filter with the given distance in bytes, i.e. `--delta=dist=distance`, in front of the
+// LZMA2 filter.  This may improve the compression of data that consists of fixed size samples, like uncompressed
+// audio or columns of numbers.  The distance is the size of a sample and must be between 1 and 256.  The filter is
+// recorded in the .xz stream, so decompression needs no special care.  The .lzma format does not support it.
+func WithDeltaFilter(distance int) Option {
+	return func(o *options) error {
+		if distance < 1 || distance > 256 {
+			return ErrOptionIllegal
+		}
+
+		o.deltaDistance = distance
+
+		return nil
+	}
+}
+
+// BCJArch is the instruction set a branch/call/jump filter is made for.
+type BCJArch string
+
+// Architectures accepted by WithBCJFilter.  `BCJARM64` requires XZ Utils 5.4 or later.
+const (
+	BCJX86      BCJArch = "x86"
+	BCJPowerPC  BCJArch = "powerpc"
+	BCJIA64     BCJArch = "ia64"
+	BCJARM      BCJArch = "arm"
+	BCJARMThumb BCJArch = "armthumb"
+	BCJARM64    BCJArch = "arm64"
+	BCJSPARC    BCJArch = "sparc"
+)
+
+// WithBCJFilter puts a branch/call/jump filter for the given architecture, e.g. `--x86`, in front of the LZMA2 filter.
+// This improves the compression of executable code for that architecture.  Only one BCJ filter can be used.  The
+// filter is recorded in the .xz stream, so decompression needs no special care.  The .lzma format does not support it.
+func WithBCJFilter(arch BCJArch) Option {
+	return func(o *options) error {
+		switch arch {
+		case BCJX86, BCJPowerPC, BCJIA64, BCJARM, BCJARMThumb, BCJARM64, BCJSPARC:
+		default:
+			return ErrOptionIllegal
+		}
+
+		if o.bcj != "" {
+			return fmt.Errorf("%w: only one BCJ filter can be used", ErrOptionIllegal)
+		}
+
+		o.bcj = arch
+
+		return nil
+	}
+}
+
+// filterNames are the filters accepted by WithFilterChain.
+var filterNames = map[string]bool{
+	"lzma1": true, "lzma2": true, "delta": true,
+	"x86": true, "powerpc": true, "ia64": true, "arm": true, "armthumb": true, "arm64": true, "sparc": true,
+}
+
+// WithFilterChain sets a custom filter chain like on the xz command line, e.g. "--lzma2=preset=9e,lc=4,pb=0" or
+// "--x86 --lzma2=preset=6", which replaces the preset.  The filters are separated by spaces and passed to xz verbatim,
+// the leading dashes are optional.  Only the names of the filters are checked, xz checks their options.  The chain
+// cannot be combined with WithDeltaFilter, WithBCJFilter or WithDictSize.  It is ignored by XZReader.
+func WithFilterChain(chain string) Option {
+	return func(o *options) error {
+		fields := strings.Fields(chain)
+		if len(fields) == 0 {
+			return fmt.Errorf("%w: empty filter chain", ErrOptionIllegal)
+		}
+
+		filters := make([]string, 0, len(fields))
+
+		for _, f := range fields {
+			f = strings.TrimPrefix(f, "--")
+
+			name, _, _ := strings.Cut(f, "=")
+			if !filterNames[name] {
+				return fmt.Errorf("%w: unknown filter %q in chain %q", ErrOptionIllegal, name, chain)
+			}
+
+			filters = append(filters, "--"+f)
+		}
+
+		o.filterChain = filters
+
+		return nil
+	}
+}
+
+// WithFallback enables an in-process compressor written in Go, which is used if the xz executable cannot be found.
+// The fallback produces valid .xz or .lzma streams, but it is several times slower than xz and compresses less.  It
+// honors the compression level, which selects the dictionary size, WithDictSize, the format and the integrity check;
+// all other options that concern the compressor process, like threads, filters or the memory limit, are ignored.
+func WithFallback() Option {
+	return func(o *options) error {
+		o.fallback = true
+
+		return nil
+	}
+}
+
+// WithBlockSize sets `--block-size`: the input is split into independent blocks of the given number of uncompressed
+// bytes.  Multi-threaded compression, see WithThreads, compresses the blocks in parallel; and blocks let readers that
+// support it seek within the stream or decompress it in parallel.  On the other hand, smaller blocks compress worse.
+// The .lzma format does not support blocks.
+func WithBlockSize(bytes uint64) Option {
+	return func(o *options) error {
+		if bytes == 0 {
+			return ErrOptionIllegal
+		}
+
+		o.blockSize = bytes
+
+		return nil
+	}
+}
+
+// WithSingleStream sets `--single-stream` for XZReader: decompression stops after the first .xz stream, and anything
+// following it is ignored instead of making xz fail.  This is useful for a stream that is embedded in a larger file.
+// Note that xz reads its input in chunks, so the XZReader may have consumed bytes beyond the end of the stream from the
+// underlying reader.  It is ignored by XZWriter.
+func WithSingleStream() Option {
+	return func(o *options) error {
+		o.singleStream = true
+
+		return nil
+	}
+}
+
+// WithTimeout limits the run time of the xz subprocess: it is killed once the timeout has passed, like it would be if
+// the context passed to the constructor was done.  The timer starts with the process, and again on Reset.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) error {
+		if d <= 0 {
+			return ErrOptionIllegal
+		}
+
+		o.timeout = d
+
+		return nil
+	}
+}
+
+// WithDeadline kills the xz subprocess once the deadline has passed, like WithTimeout does, but at a fixed point in
+// time.  This allows building the options once and reusing them for operations with a fresh deadline each, without
+// deriving a context for every operation.  If both a deadline and a timeout are configured, the earlier one applies.
+func WithDeadline(t time.Time) Option {
+	return func(o *options) error {
+		if t.IsZero() {
+			return ErrOptionIllegal
+		}
+
+		o.deadline = t
+
+		return nil
+	}
+}
+
+// WithCloseTimeout limits how long Close of an XZWriter waits for the xz subprocess to take the rest of the data and
+// exit, e.g. if xz hangs because the destination stalls.  Once the timeout has passed, the process is killed and Close
+// returns ErrCloseTimeout right away; the process is reaped in the background.  A destination that blocks forever keeps
+// the goroutine copying the output of xz alive until the write returns.  It is ignored by XZReader and the in-process
+// fallback.
+func WithCloseTimeout(d time.Duration) Option {
+	return func(o *options) error {
+		if d <= 0 {
+			return ErrOptionIllegal
+		}
+
+		o.closeTimeout = d
+
+		return nil
+	}
+}
+
+// WithSpawnRetry makes XZWriter retry starting the xz subprocess if that fails with EAGAIN, as fork and exec may on
+// heavily loaded hosts.  Starting is attempted up to attempts times in total, waiting for backoff before the first
+// retry, and twice as long before each further one, unless the context is done.  Other errors, e.g. ErrXZNotFound,
+// fail right away.  It is ignored by XZReader.
+func WithSpawnRetry(attempts int, backoff time.Duration) Option {
+	return func(o *options) error {
+		if attempts < 1 || backoff < 0 {
+			return ErrOptionIllegal
+		}
+
+		o.spawnAttempts = attempts
+		o.spawnBackoff = backoff
+
+		return nil
+	}
+}
+
+// WithGracefulCancel changes what happens to the xz subprocess of an XZWriter once the context is done: instead of
+// killing it right away, its STDIN is closed, so xz finishes the stream with the data it has got so far, and only if
+// it has not exited after the timeout, it is killed.  The destination then holds a valid, but truncated stream, at the
+// cost of cancellation taking up to the timeout.  Writes after the cancellation fail, and Close returns the error of
+// the context.  It requires a CommandFunc that creates the command with exec.CommandContext, like the default one.  It
+// is ignored by XZReader and the in-process fallback.
+func WithGracefulCancel(timeout time.Duration) Option {
+	return func(o *options) error {
+		if timeout <= 0 {
+			return ErrOptionIllegal
+		}
+
+		o.gracefulCancel = timeout
+
+		return nil
+	}
+}
+
+// WithStreamPerFlush makes XZWriter.Flush finish the current .xz stream and start a new one, by restarting the xz
+// subprocess.  The output is a concatenation of streams, which xz decompresses as a whole, and which stays valid if
+// cut at a stream boundary, e.g. an append-only log that is truncated after a crash.  Each stream starts with an
+// empty dictionary and adds 32 bytes or more of container overhead, so frequent flushes hurt the compression ratio.
+// It cannot be combined with the .lzma format or WithStoreOnly, whose streams cannot be concatenated.
+func WithStreamPerFlush() Option {
+	return func(o *options) error {
+		o.streamPerFlush = true
+
+		return nil
+	}
+}
+
+// Bounds of the dictionary size accepted by WithDictSize.
+const (
+	MinDictSize = 4 << 10
+	MaxDictSize = 1536 << 20
+)
+
+// WithDictSize sets the dictionary size of the LZMA2 filter, overriding the one of the preset; that is, it configures
+// a custom filter chain with `--lzma2=preset=…,dict=size`.  A larger dictionary may improve the ratio, but needs more
+// memory for both compression and decompression.  The size must be between MinDictSize and MaxDictSize and be either a
+// power of two or the sum of two adjacent powers of two, e.g. 8 MiB or 12 MiB, as these are the only sizes the .xz
+// header can represent exactly.  The dictionary size is recorded in the stream, so decompression needs no special
+// care.
+func WithDictSize(bytes uint64) Option {
+	return func(o *options) error {
+		if !validDictSize(bytes) {
+			return fmt.Errorf("%w: dictionary size %d is not 2^n or 2^n+2^(n-1) between %d and %d",
+				ErrOptionIllegal, bytes, MinDictSize, MaxDictSize)
+		}
+
+		o.dictSize = bytes
+
+		return nil
+	}
+}
+
+func validDictSize(n uint64) bool {
+	if n < MinDictSize || n > MaxDictSize {
+		return false
+	}
+
+	for n&1 == 0 {
+		n >>= 1
+	}
+
+	return n == 1 || n == 3
+}
+
+// WithWriteDeadline bounds the time each write to the destination of an XZWriter may take, if the destination supports
+// write deadlines like a net.Conn does: the deadline is set to the timeout from now before every write.  A timed out
+// write makes xz fail, and Close returns the error of the destination, e.g. an i/o timeout.  It is ignored by XZReader.
+func WithWriteDeadline(timeout time.Duration) Option {
+	return func(o *options) error {
+		if timeout <= 0 {
+			return ErrOptionIllegal
+		}
+
+		o.writeDeadline = timeout
+
+		return nil
+	}
+}
+
+// WithCloseDestination makes XZWriter.Close also close the destination writer after the compressor has exited, if the
+// destination implements io.Closer.  An error from closing the destination is joined with the error of the compressor.
+func WithCloseDestination() Option {
+	return func(o *options) error {
+		o.closeDestination = true
+
+		return nil
+	}
+}
+
+// WithMaxOutput limits the number of decompressed bytes an XZReader yields to defend against decompression bombs.  Once
+// the stream turns out to be longer, Read returns ErrOutputTooLarge and the xz subprocess is killed.  The limit is
+// enforced by XZReader rather than by xz and must be positive.  It is ignored by XZWriter.
+func WithMaxOutput(bytes int64) Option {
+	return func(o *options) error {
+		if bytes <= 0 {
+			return fmt.Errorf("%w: maximum output %d is not positive", ErrOptionIllegal, bytes)
+		}
+
+		o.maxOutput = bytes
+
+		return nil
+	}
+}
+
+// WithHash makes XZWriter feed the uncompressed data to h, so its digest can be computed in the same pass as the
+// compressed stream, see XZWriter.Sum.  The hash is reset when the XZWriter is started or reset.  It is ignored by
+// XZReader.
+func WithHash(h hash.Hash) Option {
+	return func(o *options) error {
+		o.hash = h
+
+		return nil
+	}
+}
+
+// WithMaxCompressed sets a budget for the compressed output of an XZWriter.  The destination receives no more bytes
+// than the budget: the write that would exceed it is cut off, and Write and Close return ErrQuotaExceeded from then on,
+// as xz dies of the broken pipe.  xz emits its output in bursts, so Write may detect the exhausted budget only some
+// time after the input that exceeded it has been accepted.  It is ignored by XZReader.
+func WithMaxCompressed(bytes int64) Option {
+	return func(o *options) error {
+		if bytes <= 0 {
+			return fmt.Errorf("%w: maximum compressed output %d is not positive", ErrOptionIllegal, bytes)
+		}
+
+		o.maxCompressed = bytes
+
+		return nil
+	}
+}
+
+// WithLogger sets a handler that is called when the xz subprocess has been started and when it has exited or has been
+// killed, e.g. to emit structured logs.  For XZWriter the exit is reported on a background goroutine, as soon as the
+// process has exited, for XZReader by Close.  The handler must not block for long.  A nil handler disables logging.
+func WithLogger(logger func(event LifecycleEvent)) Option {
+	return func(o *options) error {
+		o.logger = logger
+
+		return nil
+	}
+}
+
+// WithTolerateWarnings makes Close treat the exit code ExitCodeWarning of xz as success, as the output is usually
+// still valid then.  Errors are still returned.  The warning can be retrieved with the Warning method of XZWriter and
+// XZReader.  xz prints warnings only if the output isn't quiet, so this option drops `--quiet`.
+func WithTolerateWarnings() Option {
+	return func(o *options) error {
+		o.tolerateWarnings = true
+
+		return nil
+	}
+}
+
+// WithDir sets the working directory of the xz subprocess, which matters for relative paths passed with WithArgs.  The
+// directory must exist.
+func WithDir(dir string) Option {
+	return func(o *options) error {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("%w: working directory: %w", ErrOptionIllegal, err)
+		}
+
+		if !info.IsDir() {
+			return fmt.Errorf("%w: working directory %s is not a directory", ErrOptionIllegal, dir)
+		}
+
+		o.dir = dir
+
+		return nil
+	}
+}
+
+// WithAppend makes XZWriter seek to the end of the destination before writing to it, if the destination is an
+// io.Seeker like an *os.File.  The new stream is then appended to the streams already in the destination, e.g. an
+// append-only archive, and xz decompresses the concatenation to the combined data.  Files opened with os.O_APPEND
+// need no seeking, but it does no harm either.  It cannot be combined with the .lzma format or WithStoreOnly, whose
+// streams cannot be concatenated.  It is ignored by XZReader.
+func WithAppend() Option {
+	return func(o *options) error {
+		o.appendMode = true
+
+		return nil
+	}
+}
+
+// WithXZThreadDetection makes WithThreads(0) pass `--threads=0` to xz, letting xz use as many threads as there are CPU
+// cores rather than runtime.GOMAXPROCS(0) threads.  It has no effect unless WithThreads(0) is given as well.
+func WithXZThreadDetection() Option {
+	return func(o *options) error {
+		o.xzThreadDetection = true
+
+		return nil
+	}
+}
+
+// WithReproducible makes the output of XZWriter depend on nothing but the data, the options and the version of XZ
+// Utils, so that identical input yields a byte-identical .xz stream, e.g. for content-addressable storage.  It forces
+// single-threaded compression, i.e. `--threads=1`, and the CRC64 integrity check unless WithCheck chooses another one.
+//
+// The output of xz is affected by the compression level, preset, filters, dictionary size, format, check, block size,
+// memory limit, the number of threads, and the points at which Flush is called, which are all deterministic.  It is
+// not affected by the time or the machine, except that WithThreads(0) depends on the number of CPUs.  WithFlushTimeout
+// depends on timing and cannot be combined with WithReproducible, neither can multi-threading, nor the in-process
+// fallback, which compresses differently.  Different versions of XZ Utils may produce different output for the same
+// input, so pin the version if the output must be stable over time.  It is ignored by XZReader.
+func WithReproducible() Option {
+	return func(o *options) error {
+		o.reproducible = true
+		o.threads = 1
+		o.threadsSet = true
+
+		return nil
+	}
+}
+
+// WithOutputWrapper inserts a writer between xz and the destination, e.g. to add framing or encryption to the
+// compressed stream without another copy.  The wrapper is called with the destination whenever XZWriter starts writing
+// to one, i.e. by the constructor and by Reset, and xz writes to the writer it returns.  If that writer is an
+// io.Closer, Close closes it after the process has exited, before WithCloseDestination closes the destination.  Stats,
+// Result and WithMaxCompressed count the bytes xz writes to the wrapper.  It is ignored by XZReader.
+func WithOutputWrapper(wrap func(io.Writer) io.Writer) Option {
+	return func(o *options) error {
+		if wrap == nil {
+			return ErrOptionIllegal
+		}
+
+		o.outputWrapper = wrap
+
+		return nil
+	}
+}
+
+// WithIndexWriter makes Close of an XZWriter write the index of the .xz stream as JSON to w, see Index: the offsets
+// and sizes of the blocks, so that tools can seek to a block of a large archive without scanning it.  Together with
+// WithBlockSize, it allows random access at the granularity of the block size.  Offsets are relative to the start of
+// the stream, which matters only with WithAppend.  Close writes the index after the process has exited successfully,
+// for every stream in case of Reset.  It cannot be combined with the .lzma format, which has no index, or with
+// WithStreamPerFlush.  It is ignored by XZReader.
+func WithIndexWriter(w io.Writer) Option {
+	return func(o *options) error {
+		if w == nil {
+			return ErrOptionIllegal
+		}
+
+		o.indexWriter = w
+
+		return nil
+	}
+}
+
+// WithBlockCount makes XZWriter keep the end of each .xz stream, so that BlockCount can count the blocks in its index.
+// This costs up to 64 KiB of memory for each writer, and a copy of all of the compressed output, which is why it is
+// not the default.  WithIndexWriter implies it.  It is ignored by XZReader.
+func WithBlockCount() Option {
+	return func(o *options) error {
+		o.blockCount = true
+
+		return nil
+	}
+}
+
+// WithStoreOnly makes XZWriter a thin container for data that is compressed already, for callers that offer a "store"
+// level.  xz has no filter that just copies the data, so it writes a raw LZMA2 stream, i.e. `--format=raw`, with the
+// cheapest settings: a 4 KiB dictionary and the fastest match finder.  LZMA2 stores incompressible chunks as they are,
+// so the output exceeds the input by about 50 bytes per MiB, and it saves the 60 bytes or so of the .xz container
+// and about a quarter of the CPU time of level 0.  Data that does compress is still compressed, though poorly.
+//
+// A raw stream has neither a header nor an integrity check, so it cannot be detected or verified: it can only be
+// decompressed by an XZReader that is configured with WithStoreOnly, too, or by `xz --decompress --format=raw` with
+// the same filter options.  Concatenated raw streams cannot be decompressed either.  WithStoreOnly cannot be combined
+// with options that choose the format, the level or the filters, nor with WithCheck, WithIndexWriter, WithFallback,
+// WithStreamPerFlush or WithAppend.
+func WithStoreOnly() Option {
+	return func(o *options) error {
+		o.storeOnly = true
+
+		return nil
+	}
+}
+
+// withInputFile makes xz read the named file instead of STDIN, see CompressFile.
+func withInputFile(path string) Option {
+	return func(o *options) error {
+		o.inputFile = path
 
 		return nil
 	}
 }
 
 type options struct {
+	binary               string
 	compressLevel        int
 	extreme              bool
+	levelSet             bool   // by WithCompressLevel or WithExtreme
+	preset               string // by WithPreset
+	threads              int
+	threadsSet           bool
+	xzThreadDetection    bool
+	reproducible         bool
+	flushTimeout         time.Duration
+	progress             func(bytesIn, bytesOut int64)
+	memLimit             uint64
+	strictMemory         bool
+	check                CheckType
+	leakHandler          func(createdAt string)
+	format               Format
+	nice                 int
+	niceSet              bool
+	extraArgs            []string
+	commandFunc          CommandFunc
+	bufferSize           int
+	deltaDistance        int
+	bcj                  BCJArch
+	fallback             bool
+	blockSize            uint64
+	singleStream         bool
+	timeout              time.Duration
+	deadline             time.Time
+	gracefulCancel       time.Duration
+	closeTimeout         time.Duration
+	spawnAttempts        int
+	spawnBackoff         time.Duration
+	streamPerFlush       bool
+	dictSize             uint64
+	closeDestination     bool
+	outputWrapper        func(io.Writer) io.Writer
+	indexWriter          io.Writer
+	blockCount           bool
+	inputFile            string
+	storeOnly            bool
+	writeDeadline        time.Duration
+	maxCompressed        int64
+	logger               func(event LifecycleEvent)
+	tolerateWarnings     bool
+	dir                  string
+	appendMode           bool
+	filterChain          []string
+	maxOutput            int64
+	hash                 hash.Hash
 	verboseWriter        io.Writer
+	stderrWriter         io.Writer
 	separateProcessGroup bool
+	sysProcAttr          *syscall.SysProcAttr
+}
+
+// ValidateOptions checks the options for XZWriter like NewWithOptions does, but without starting xz.  This is useful to
+// reject an illegal configuration, e.g. one built from command line flags, before doing any work.  Problems that only
+// xz can detect, such as an unknown argument passed with WithArgs, are not found.
+func ValidateOptions(opts ...Option) error {
+	_, err := newOptions(opts)
+
+	return err
+}
+
+// newOptions applies opts to the default options and validates the result.
+func newOptions(opts []Option) (options, error) {
+	o := defaultOptions()
+
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return options{}, err
+		}
+	}
+
+	if err := o.validate(); err != nil {
+		return options{}, err
+	}
+
+	return o, nil
+}
+
+// validate checks the combination of options.  Single options are checked when they are applied.
+func (o *options) validate() error {
+	if o.filterChain != nil && (o.deltaDistance != 0 || o.bcj != "" || o.dictSize != 0) {
+		return fmt.Errorf("%w: a filter chain cannot be combined with delta, BCJ or dictionary size options",
+			ErrOptionIllegal)
+	}
+
+	if o.preset != "" && o.levelSet {
+		return fmt.Errorf("%w: preset %q cannot be combined with a compression level or the extreme flag",
+			ErrOptionIllegal, o.preset)
+	}
+
+	if o.format == FormatAuto {
+		return fmt.Errorf("%w: format %s is only supported for decompression", ErrOptionIllegal, o.format)
+	}
+
+	if o.storeOnly && (o.format != "" || o.preset != "" || o.levelSet || o.filterChain != nil || o.deltaDistance != 0 ||
+		o.bcj != "" || o.dictSize != 0 || o.check != "" || o.indexWriter != nil) {
+		return fmt.Errorf("%w: store-only mode cannot be combined with format, level, filter, check or index options",
+			ErrOptionIllegal)
+	}
+
+	if o.storeOnly && (o.fallback || o.streamPerFlush || o.appendMode) {
+		return fmt.Errorf("%w: store-only mode requires a single raw stream written by xz", ErrOptionIllegal)
+	}
+
+	if o.indexWriter != nil && (o.format == FormatLZMA || o.streamPerFlush) {
+		return fmt.Errorf("%w: the index requires a single stream of the %s format", ErrOptionIllegal, FormatXZ)
+	}
+
+	if o.reproducible {
+		switch {
+		case o.flushTimeout > 0:
+			return fmt.Errorf("%w: a flush timeout is not reproducible", ErrOptionIllegal)
+		case o.threads != 1:
+			return fmt.Errorf("%w: multi-threading is not reproducible", ErrOptionIllegal)
+		case o.fallback:
+			return fmt.Errorf("%w: the fallback is not reproducible", ErrOptionIllegal)
+		}
+	}
+
+	if o.format == FormatLZMA {
+		if o.check != "" {
+			return fmt.Errorf("%w: format %s does not support integrity checks", ErrOptionIllegal, o.format)
+		}
+
+		if o.threadsSet && o.threads != 1 {
+			return fmt.Errorf("%w: format %s does not support multi-threading", ErrOptionIllegal, o.format)
+		}
+
+		if o.deltaDistance != 0 {
+			return fmt.Errorf("%w: format %s does not support the delta filter", ErrOptionIllegal, o.format)
+		}
+
+		if o.bcj != "" {
+			return fmt.Errorf("%w: format %s does not support BCJ filters", ErrOptionIllegal, o.format)
+		}
+
+		if o.blockSize != 0 {
+			return fmt.Errorf("%w: format %s does not support blocks", ErrOptionIllegal, o.format)
+		}
+
+		if o.streamPerFlush || o.appendMode {
+			return fmt.Errorf("%w: format %s does not support concatenated streams", ErrOptionIllegal, o.format)
+		}
+	}
+
+	return nil
+}
+
+// readsInputFile reports whether xz reads the file of withInputFile.  Options that need to see the uncompressed data,
+// and the fallback, which cannot read a file, require the data to be streamed through STDIN.
+func (o *options) readsInputFile() bool {
+	return o.inputFile != "" && o.hash == nil && o.progress == nil && !o.fallback
+}
+
+// stderr returns the writer for STDERR of the xz subprocess: the capture for error messages, teed to the writers of
+// WithVerbose and WithStderr, if any.
+func (o *options) stderr(capture *tailBuffer) io.Writer {
+	writers := []io.Writer{capture}
+
+	if o.verboseWriter != nil {
+		writers = append(writers, o.verboseWriter)
+	}
+
+	if o.stderrWriter != nil {
+		writers = append(writers, o.stderrWriter)
+	}
+
+	if len(writers) == 1 {
+		return capture
+	}
+
+	return io.MultiWriter(writers...)
+}
+
+// inputArgs returns the arguments that end the command line of xz and name its input: the file of withInputFile, if
+// xz reads it, otherwise `-` for STDIN.
+func (o *options) inputArgs() []string {
+	if o.readsInputFile() {
+		return []string{"--", o.inputFile}
+	}
+
+	return []string{"--", "-"}
+}
+
+// threadsArg returns the `--threads` argument for the configured number of threads.
+func (o *options) threadsArg() string {
+	n := o.threads
+	if n == 0 && !o.xzThreadDetection {
+		n = runtime.GOMAXPROCS(0)
+	}
+
+	return "--threads=" + strconv.Itoa(n)
+}
+
+// commandContext derives the context of the xz subprocess from ctx.  The cancel function is nil if the context is ctx.
+func (o *options) commandContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline := o.deadline
+	if o.timeout > 0 {
+		if d := time.Now().Add(o.timeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+
+	if !deadline.IsZero() {
+		return context.WithDeadline(ctx, deadline)
+	}
+
+	return ctx, nil
+}
+
+// BinaryEnv is the name of the environment variable that overrides the default executable `xz`.
+const BinaryEnv = "XZWRITER_BINARY"
+
+func defaultOptions() options {
+	binary := os.Getenv(BinaryEnv)
+	if binary == "" {
+		binary = "xz"
+	}
+
+	return options{
+		binary:        binary,
+		commandFunc:   exec.CommandContext,
+		bufferSize:    DefaultBufferSize,
+		compressLevel: Default,
+	}
 }
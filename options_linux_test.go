@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jwkohnen/xzwriter"
+)
+
+func TestNice(t *testing.T) {
+	requireXZ(t)
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithNice(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer xz.Close()
+
+	if n := niceOf(t, xz.PID()); n != 7 {
+		t.Errorf("nice %d, want 7", n)
+	}
+}
+
+// niceOf reads the nice value of the process pid from /proc.
+func niceOf(t *testing.T, pid int) int {
+	t.Helper()
+
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fields after the command name, which is in parentheses, start with
+	// the state; the nice value is the 19th field of the line.
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+
+	n, err := strconv.Atoi(fields[16])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+func TestSysProcAttr(t *testing.T) {
+	requireXZ(t)
+
+	for _, tc := range []struct {
+		name     string
+		opts     []xzwriter.Option
+		ownGroup bool
+	}{
+		{"default", nil, false},
+		{"separate process group", []xzwriter.Option{xzwriter.WithSeparateProcessGroup()}, true},
+		{"setpgid", []xzwriter.Option{xzwriter.WithSysProcAttr(&syscall.SysProcAttr{Setpgid: true})}, true},
+		{"precedence", []xzwriter.Option{
+			xzwriter.WithSeparateProcessGroup(), xzwriter.WithSysProcAttr(&syscall.SysProcAttr{}),
+		}, false},
+	} {
+		xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, tc.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pgid, err := syscall.Getpgid(xz.PID())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ownGroup := pgid == xz.PID(); ownGroup != tc.ownGroup {
+			t.Errorf("%s: process group %d of process %d", tc.name, pgid, xz.PID())
+		}
+
+		if err := xz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
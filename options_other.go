@@ -0,0 +1,28 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package xzwriter
+
+import (
+	"os"
+	"syscall"
+)
+
+// WithSysProcAttr is a no-op on this platform.
+func WithSysProcAttr(*syscall.SysProcAttr) Option {
+	return func(*options) error {
+		return nil
+	}
+}
+
+func sysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+func setPriority(int, int) error {
+	return nil
+}
+
+func killedBySIGPIPE(*os.ProcessState) bool {
+	return false
+}
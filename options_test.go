@@ -0,0 +1,466 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/jwkohnen/xzwriter"
+)
+
+func TestMemLimit(t *testing.T) {
+	requireXZ(t)
+
+	// xz scales the dictionary of level 9 down to meet the limit.
+	data := text(64 << 10)
+	assertRoundTrip(t, compress(t, data, xzwriter.WithCompressLevel(xzwriter.Best), xzwriter.WithMemLimit(32<<20)), data)
+
+	_, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithMemLimit(xzwriter.MinMemLimit-1))
+	if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+		t.Errorf("got %v, want ErrOptionIllegal", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	requireXZ(t)
+
+	data := text(64 << 10)
+
+	for check, want := range map[xzwriter.CheckType]string{
+		xzwriter.CheckNone:   "None",
+		xzwriter.CheckCRC32:  "CRC32",
+		xzwriter.CheckCRC64:  "CRC64",
+		xzwriter.CheckSHA256: "SHA-256",
+	} {
+		name := filepath.Join(t.TempDir(), "data.xz")
+		if err := os.WriteFile(name, compress(t, data, xzwriter.WithCheck(check)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if blocks := xzList(t, name); len(blocks) != 1 || blocks[0].check != want {
+			t.Errorf("check %s: xz --list reports %+v", check, blocks)
+		}
+	}
+
+	_, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithCheck("md5"))
+	if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+		t.Errorf("got %v, want ErrOptionIllegal", err)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	requireXZ(t)
+
+	data := text(64 << 10)
+
+	for _, f := range []xzwriter.Format{xzwriter.FormatXZ, xzwriter.FormatLZMA} {
+		assertRoundTrip(t, compress(t, data, xzwriter.WithFormat(f)), data, "--format="+string(f))
+	}
+}
+
+func TestFormatIllegal(t *testing.T) {
+	for name, opts := range map[string][]xzwriter.Option{
+		"unknown": {xzwriter.WithFormat("zip")},
+		"check":   {xzwriter.WithFormat(xzwriter.FormatLZMA), xzwriter.WithCheck(xzwriter.CheckSHA256)},
+		"threads": {xzwriter.WithFormat(xzwriter.FormatLZMA), xzwriter.WithThreads(2)},
+		"auto":    {xzwriter.WithFormat(xzwriter.FormatAuto)},
+	} {
+		_, err := xzwriter.NewWithOptions(context.Background(), io.Discard, opts...)
+		if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+			t.Errorf("%s: got %v, want ErrOptionIllegal", name, err)
+		}
+	}
+}
+
+func TestExtreme(t *testing.T) {
+	requireXZ(t)
+
+	data := text(256 << 10)
+
+	for _, l := range []int{xzwriter.Fast, xzwriter.Default, xzwriter.Best} {
+		plain := compress(t, data, xzwriter.WithCompressLevel(l))
+		extreme := compress(t, data, xzwriter.WithCompressLevel(l), xzwriter.WithExtreme(true))
+
+		assertRoundTrip(t, extreme, data)
+
+		if len(extreme) > len(plain) {
+			t.Errorf("level %d: %d bytes with --extreme, %d bytes without", l, len(extreme), len(plain))
+		}
+	}
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithExtreme(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if args := strings.Join(xz.Args(), " "); strings.Contains(args, "--extreme") {
+		t.Errorf("WithExtreme(false): args %q", args)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLevelAliases(t *testing.T) {
+	for _, tc := range []struct {
+		level int
+		want  string
+	}{
+		{xzwriter.LevelBestSpeed, "-0"},
+		{xzwriter.LevelBestCompression, "-9"},
+	} {
+		var args []string
+
+		record := func(ctx context.Context, _ string, arg ...string) *exec.Cmd {
+			args = arg
+
+			return exec.CommandContext(ctx, "cat")
+		}
+
+		xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard,
+			xzwriter.WithCommandFunc(record), xzwriter.WithCompressLevel(tc.level))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := xz.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if joined := strings.Join(args, " ") + " "; !strings.Contains(joined, tc.want+" ") {
+			t.Errorf("level %d: args %q lack %q", tc.level, joined, tc.want)
+		}
+	}
+}
+
+func TestBinaryEnv(t *testing.T) {
+	t.Setenv(xzwriter.BinaryEnv, "definitely-not-xz")
+
+	if _, err := xzwriter.NewWithOptions(context.Background(), io.Discard); !errors.Is(err, xzwriter.ErrXZNotFound) {
+		t.Fatalf("got %v, want ErrXZNotFound", err)
+	}
+
+	requireXZ(t)
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithBinary("xz"))
+	if err != nil {
+		t.Fatalf("WithBinary does not take precedence: %v", err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNiceIllegal(t *testing.T) {
+	for _, n := range []int{-21, 20} {
+		_, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithNice(n))
+		if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+			t.Errorf("nice %d: got %v, want ErrOptionIllegal", n, err)
+		}
+	}
+}
+
+func TestArgs(t *testing.T) {
+	requireXZ(t)
+
+	data := text(256 << 10)
+
+	name := filepath.Join(t.TempDir(), "data.xz")
+	if err := os.WriteFile(name, compress(t, data, xzwriter.WithArgs("--block-size=64KiB")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if blocks := xzList(t, name); len(blocks) != 4 {
+		t.Errorf("%d blocks, want 4", len(blocks))
+	}
+}
+
+func TestFilters(t *testing.T) {
+	requireXZ(t)
+
+	data := text(256 << 10)
+
+	for name, opt := range map[string]xzwriter.Option{
+		"delta":        xzwriter.WithDeltaFilter(4),
+		"bcj":          xzwriter.WithBCJFilter(xzwriter.BCJX86),
+		"dict size":    xzwriter.WithDictSize(12 << 20),
+		"filter chain": xzwriter.WithFilterChain("--lzma2=preset=9e,lc=4,pb=0"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			assertRoundTrip(t, compress(t, data, opt), data)
+		})
+	}
+
+	lzma := []xzwriter.Option{xzwriter.WithFormat(xzwriter.FormatLZMA), xzwriter.WithDictSize(1 << 20)}
+	assertRoundTrip(t, compress(t, data, lzma...), data, "--format=lzma")
+}
+
+func TestFiltersIllegal(t *testing.T) {
+	for name, opts := range map[string][]xzwriter.Option{
+		"delta 0":      {xzwriter.WithDeltaFilter(0)},
+		"delta 257":    {xzwriter.WithDeltaFilter(257)},
+		"delta + lzma": {xzwriter.WithDeltaFilter(4), xzwriter.WithFormat(xzwriter.FormatLZMA)},
+		"bcj":          {xzwriter.WithBCJFilter("z80")},
+		"two bcj":      {xzwriter.WithBCJFilter(xzwriter.BCJX86), xzwriter.WithBCJFilter(xzwriter.BCJARM)},
+		"bcj + lzma":   {xzwriter.WithBCJFilter(xzwriter.BCJX86), xzwriter.WithFormat(xzwriter.FormatLZMA)},
+		"dict small":   {xzwriter.WithDictSize(1024)},
+		"dict odd":     {xzwriter.WithDictSize(5 << 20)},
+		"dict large":   {xzwriter.WithDictSize(2 << 30)},
+		"empty chain":  {xzwriter.WithFilterChain(" ")},
+		"chain":        {xzwriter.WithFilterChain("--zip")},
+		"chain + dict": {xzwriter.WithFilterChain("--lzma2"), xzwriter.WithDictSize(8 << 20)},
+	} {
+		_, err := xzwriter.NewWithOptions(context.Background(), io.Discard, opts...)
+		if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+			t.Errorf("%s: got %v, want ErrOptionIllegal", name, err)
+		}
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	requireXZ(t)
+
+	data := text(256 << 10)
+
+	name := filepath.Join(t.TempDir(), "data.xz")
+	if err := os.WriteFile(name, compress(t, data, xzwriter.WithBlockSize(64<<10)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := xzList(t, name)
+	if len(blocks) != 4 {
+		t.Fatalf("%d blocks, want 4", len(blocks))
+	}
+
+	for i, b := range blocks {
+		if b.uncompressedSize != 64<<10 || b.uncompressedOffset != int64(i)*64<<10 {
+			t.Errorf("block %d: %+v", i, b)
+		}
+	}
+
+	for name, opts := range map[string][]xzwriter.Option{
+		"zero": {xzwriter.WithBlockSize(0)},
+		"lzma": {xzwriter.WithBlockSize(64 << 10), xzwriter.WithFormat(xzwriter.FormatLZMA)},
+	} {
+		_, err := xzwriter.NewWithOptions(context.Background(), io.Discard, opts...)
+		if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+			t.Errorf("%s: got %v, want ErrOptionIllegal", name, err)
+		}
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	for name, opts := range map[string][]xzwriter.Option{
+		"level":                  {xzwriter.WithCompressLevel(12)},
+		"threads":                {xzwriter.WithThreads(-2)},
+		"format":                 {xzwriter.WithFormat("zip")},
+		"check":                  {xzwriter.WithCheck("md5")},
+		"lzma check":             {xzwriter.WithFormat(xzwriter.FormatLZMA), xzwriter.WithCheck(xzwriter.CheckSHA256)},
+		"memlimit":               {xzwriter.WithMemLimit(1024)},
+		"dict size small":        {xzwriter.WithDictSize(1024)},
+		"dict size odd":          {xzwriter.WithDictSize(5 << 20)},
+		"delta":                  {xzwriter.WithDeltaFilter(257)},
+		"bcj":                    {xzwriter.WithBCJFilter("z80")},
+		"two bcj":                {xzwriter.WithBCJFilter(xzwriter.BCJX86), xzwriter.WithBCJFilter(xzwriter.BCJARM)},
+		"nice":                   {xzwriter.WithNice(20)},
+		"max output":             {xzwriter.WithMaxOutput(0)},
+		"lzma stream per flush":  {xzwriter.WithStreamPerFlush(), xzwriter.WithFormat(xzwriter.FormatLZMA)},
+		"store stream per flush": {xzwriter.WithStreamPerFlush(), xzwriter.WithStoreOnly()},
+		"lzma append":            {xzwriter.WithAppend(), xzwriter.WithFormat(xzwriter.FormatLZMA)},
+		"store append":           {xzwriter.WithAppend(), xzwriter.WithStoreOnly()},
+	} {
+		if err := xzwriter.ValidateOptions(opts...); !errors.Is(err, xzwriter.ErrOptionIllegal) {
+			t.Errorf("%s: got %v, want ErrOptionIllegal", name, err)
+		}
+	}
+
+	if err := xzwriter.ValidateOptions(xzwriter.WithCompressLevel(xzwriter.Best), xzwriter.WithThreads(0)); err != nil {
+		t.Errorf("legal options: %v", err)
+	}
+}
+
+func TestStrictMemory(t *testing.T) {
+	requireXZ(t)
+	t.Setenv("LC_ALL", "C")
+
+	// Unlike in TestMemLimit, xz must not scale the dictionary down.
+	_, err := xzwriter.CompressBytes(context.Background(), text(64<<10), xzwriter.WithCompressLevel(xzwriter.Best),
+		xzwriter.WithMemLimit(32<<20), xzwriter.WithStrictMemory())
+
+	var xzErr *xzwriter.XZError
+	if !errors.As(err, &xzErr) {
+		t.Fatalf("got %v, want an *XZError", err)
+	}
+
+	if !strings.Contains(xzErr.Stderr, "limit") {
+		t.Errorf("stderr %q does not mention the limit", xzErr.Stderr)
+	}
+}
+
+func TestPreset(t *testing.T) {
+	presets := []struct {
+		preset string
+		args   string // the arguments the preset translates to, empty if the preset is illegal
+	}{
+		{"0", "-0"},
+		{"6", "-6"},
+		{"9", "-9"},
+		{"0e", "-0 --extreme"},
+		{"9e", "-9 --extreme"},
+		{"-0", "-0"},
+		{"-9e", "-9 --extreme"},
+		{"", ""},
+		{"-", ""},
+		{"e", ""},
+		{"10", ""},
+		{"-10", ""},
+		{"9E", ""},
+		{"9ee", ""},
+		{"e9", ""},
+		{"--9", ""},
+		{" 9", ""},
+		{"9 ", ""},
+		{"a", ""},
+		{"/", ""}, // the byte before '0'
+		{":", ""}, // the byte after '9'
+	}
+
+	for _, tc := range presets {
+		err := xzwriter.ValidateOptions(xzwriter.WithPreset(tc.preset))
+
+		switch {
+		case tc.args == "" && !errors.Is(err, xzwriter.ErrOptionIllegal):
+			t.Errorf("%q: got %v, want ErrOptionIllegal", tc.preset, err)
+		case tc.args != "" && err != nil:
+			t.Errorf("%q: %v", tc.preset, err)
+		}
+	}
+
+	for name, opts := range map[string][]xzwriter.Option{
+		"level":   {xzwriter.WithPreset("6"), xzwriter.WithCompressLevel(6)},
+		"extreme": {xzwriter.WithExtreme(true), xzwriter.WithPreset("6")},
+	} {
+		if err := xzwriter.ValidateOptions(opts...); !errors.Is(err, xzwriter.ErrOptionIllegal) {
+			t.Errorf("preset and %s: got %v, want ErrOptionIllegal", name, err)
+		}
+	}
+
+	requireXZ(t)
+
+	for _, tc := range presets {
+		if tc.args == "" {
+			continue
+		}
+
+		xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithPreset(tc.preset))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		args := strings.Join(xz.Args(), " ")
+		if !strings.Contains(args+" ", " "+tc.args+" ") {
+			t.Errorf("%q: args %q lack %q", tc.preset, args, tc.args)
+		}
+
+		if extreme := strings.HasSuffix(tc.preset, "e"); strings.Contains(args, "--extreme") != extreme {
+			t.Errorf("%q: args %q", tc.preset, args)
+		}
+
+		if err := xz.Close(); err != nil {
+			t.Errorf("%q: %v", tc.preset, err)
+		}
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir := t.TempDir()
+
+	in := filepath.Join(dir, "in")
+	if err := os.WriteFile(in, []byte("relative"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, illegal := range []string{filepath.Join(dir, "missing"), in} {
+		_, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithDir(illegal))
+		if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+			t.Errorf("WithDir(%q): got %v, want ErrOptionIllegal", illegal, err)
+		}
+	}
+
+	requireXZ(t)
+
+	// xz compresses the file given by its relative path in front of STDIN.
+	var buf bytes.Buffer
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), &buf, xzwriter.WithDir(dir), xzwriter.WithArgs("in"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertRoundTrip(t, buf.Bytes(), []byte("relative"))
+}
+
+func TestThreadsFollowGOMAXPROCS(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(3))
+
+	for _, tc := range []struct {
+		opts []xzwriter.Option
+		want string
+	}{
+		{[]xzwriter.Option{xzwriter.WithThreads(0)}, "--threads=3"},
+		{[]xzwriter.Option{xzwriter.WithThreads(0), xzwriter.WithXZThreadDetection()}, "--threads=0"},
+		{[]xzwriter.Option{xzwriter.WithThreads(2), xzwriter.WithXZThreadDetection()}, "--threads=2"},
+	} {
+		var args []string
+
+		record := func(ctx context.Context, _ string, arg ...string) *exec.Cmd {
+			args = arg
+
+			return exec.CommandContext(ctx, "cat")
+		}
+
+		opts := append([]xzwriter.Option{xzwriter.WithCommandFunc(record)}, tc.opts...)
+
+		xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := xz.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if joined := strings.Join(args, " "); !strings.Contains(joined, tc.want) {
+			t.Errorf("args %q lack %q", joined, tc.want)
+		}
+	}
+}
@@ -1,7 +1,13 @@
+//go:build linux || darwin
 // +build linux darwin
 
 package xzwriter
 
+import (
+	"os"
+	"syscall"
+)
+
 // WithSeparateProcessGroup set's the process group of the `xz` subprocess to its own, separate process group.  When
 // the program using this library is started in a shell session, hitting CTRL+C will send an interrupt signal to both
 // processes.  That means that the `xz` process terminates immediately without reading STDIN to its end, instead
@@ -10,9 +16,31 @@ package xzwriter
 // If the program using this library wants to handle the SIGINT gracefully, one needs to prevent the shell from sending
 // the SIGINT to the xz subprocess also.  Running `xz` in a separate process group achieves that.
 func WithSeparateProcessGroup() Option {
-	return func(xz *XZWriter) error {
-		xz.opts.separateProcessGroup = true
+	return func(o *options) error {
+		o.separateProcessGroup = true
+
+		return nil
+	}
+}
+
+// WithSysProcAttr sets the OS specific attributes of the xz subprocess, see exec.Cmd.SysProcAttr.  This is an advanced
+// option for callers that need to control, e.g., the process group, namespaces or credentials of the subprocess, and
+// the meaning of the attributes depends on the platform.  It takes precedence over WithSeparateProcessGroup.  The
+// attributes are not copied, so they must not be modified while an XZWriter or XZReader is using them.
+func WithSysProcAttr(attr *syscall.SysProcAttr) Option {
+	return func(o *options) error {
+		o.sysProcAttr = attr
 
 		return nil
 	}
 }
+
+func setPriority(pid, nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, pid, nice)
+}
+
+func killedBySIGPIPE(ps *os.ProcessState) bool {
+	ws, ok := ps.Sys().(syscall.WaitStatus)
+
+	return ok && ws.Signaled() && ws.Signal() == syscall.SIGPIPE
+}
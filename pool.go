@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Pool keeps a number of xz processes started in advance, so Get returns an
+// XZWriter without waiting for a process to start. Each process still
+// compresses a single stream: Get starts a replacement in the background.
+//
+// The processes of a Pool are idle until Get hands them out, but they hold
+// their memory and file descriptors. Every XZWriter returned by Get must be
+// closed like one returned by NewWithOptions.
+type Pool struct {
+	ctx  context.Context
+	opts []Option
+	warm chan *XZWriter
+
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup // refills in flight
+}
+
+// NewPool starts size xz processes with the options and returns a Pool that
+// hands them out. The context applies to all processes of the pool.
+// WithFallback is not supported, as the fallback encoder has nothing to start
+// in advance. Neither are WithHash and WithIndexWriter, as the writers of a
+// pool would share the hash and the index writer.
+func NewPool(ctx context.Context, size int, opts ...Option) (*Pool, error) {
+	if ctx == nil {
+		panic("nil Context")
+	}
+
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if size < 1 {
+		return nil, fmt.Errorf("%w: pool size %d is not positive", ErrOptionIllegal, size)
+	}
+
+	if o.fallback {
+		return nil, fmt.Errorf("%w: a pool does not support the fallback", ErrOptionIllegal)
+	}
+
+	if o.hash != nil || o.indexWriter != nil {
+		return nil, fmt.Errorf("%w: a pool does not support a hash or an index writer", ErrOptionIllegal)
+	}
+
+	p := &Pool{ctx: ctx, opts: opts, warm: make(chan *XZWriter, size)}
+
+	for i := 0; i < size; i++ {
+		xz, err := p.startWarm()
+		if err != nil {
+			return nil, errors.Join(err, p.Close())
+		}
+
+		p.warm <- xz
+	}
+
+	return p, nil
+}
+
+// Get returns an XZWriter that compresses to w, using a process that has been
+// started in advance. If there is none left, e.g. because Get is called faster
+// than processes start, Get starts a process like NewWithOptions does.
+func (p *Pool) Get(w io.Writer) (*XZWriter, error) {
+	for {
+		var xz *XZWriter
+
+		select {
+		case xz = <-p.warm:
+			p.refill()
+		default:
+			return NewWithOptions(p.ctx, w, p.opts...)
+		}
+
+		// The process may have died in the meantime, e.g. by the context.
+		if xz.proc.exited() {
+			_ = discardWarm(xz)
+
+			continue
+		}
+
+		if err := xz.setDestination(w); err != nil {
+			_ = discardWarm(xz)
+
+			return nil, err
+		}
+
+		xz.started = time.Now()
+		close(xz.out.ready)
+
+		return xz, nil
+	}
+}
+
+// Close stops the processes that have not been handed out. It does not affect
+// the XZWriters returned by Get.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	p.wg.Wait()
+
+	var errs []error
+
+	for {
+		select {
+		case xz := <-p.warm:
+			errs = append(errs, discardWarm(xz))
+		default:
+			return errors.Join(errs...)
+		}
+	}
+}
+
+// startWarm starts an XZWriter whose destination is set by Get.
+func (p *Pool) startWarm() (*XZWriter, error) {
+	o, err := newOptions(p.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	xz := &XZWriter{ctx: p.ctx, opts: o, out: &countingWriter{ready: make(chan struct{})}}
+
+	if err := xz.startFresh(); err != nil {
+		return nil, err
+	}
+
+	return xz, nil
+}
+
+// refill starts a replacement for a process handed out by Get in the
+// background.
+func (p *Pool) refill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+
+	p.wg.Add(1)
+
+	go func() {
+		defer p.wg.Done()
+
+		// If the process cannot be started, Get starts one when the pool has
+		// run dry.
+		xz, err := p.startWarm()
+		if err != nil {
+			return
+		}
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		if p.closed {
+			_ = discardWarm(xz)
+
+			return
+		}
+
+		p.warm <- xz
+	}()
+}
+
+// discardWarm closes an XZWriter that has not been handed out.
+func discardWarm(xz *XZWriter) error {
+	xz.out.w = io.Discard
+	close(xz.out.ready)
+
+	return xz.Close()
+}
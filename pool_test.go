@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/jwkohnen/xzwriter"
+)
+
+func TestPool(t *testing.T) {
+	requireXZ(t)
+
+	pool, err := xzwriter.NewPool(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Get more writers than the pool holds, so it has to start some.
+	for i := 0; i < 5; i++ {
+		var buf bytes.Buffer
+
+		xz, err := pool.Get(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := text(64<<10 + i)
+		if _, err := xz.Write(data); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := xz.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		assertRoundTrip(t, buf.Bytes(), data)
+	}
+
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolRejectsOptions(t *testing.T) {
+	for _, opt := range []xzwriter.Option{
+		xzwriter.WithFallback(), xzwriter.WithHash(sha256.New()), xzwriter.WithIndexWriter(io.Discard),
+	} {
+		if _, err := xzwriter.NewPool(context.Background(), 1, opt); !errors.Is(err, xzwriter.ErrOptionIllegal) {
+			t.Errorf("got %v, want ErrOptionIllegal", err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter
+
+import (
+	"os/exec"
+	"time"
+)
+
+// process is a started subprocess that is waited for in the background, so
+// that its exit can be observed without blocking.
+type process struct {
+	cmd   *exec.Cmd
+	done  chan struct{}
+	err   error     // the result of cmd.Wait, valid once done is closed
+	start time.Time // when the process has been started
+	end   time.Time // when Wait has returned, valid once done is closed
+}
+
+// startProcess starts cmd and waits for it in the background. Start and exit
+// are reported to the logger, if any.
+func startProcess(cmd *exec.Cmd, logger func(LifecycleEvent)) (*process, error) {
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	logStarted(logger, cmd, start)
+
+	p := &process{cmd: cmd, done: make(chan struct{}), start: start}
+
+	go func() {
+		p.err = cmd.Wait()
+		p.end = time.Now()
+		logExited(logger, cmd, start)
+		close(p.done)
+	}()
+
+	return p, nil
+}
+
+// wait blocks until the process has exited and returns the result of Wait.
+func (p *process) wait() error {
+	<-p.done
+
+	return p.err
+}
+
+// waitUntil is like wait, but gives up once expired is closed. It reports
+// false if expired has been closed, even if the process has exited meanwhile.
+func (p *process) waitUntil(expired <-chan struct{}) (ok bool, err error) {
+	select {
+	case <-p.done:
+	case <-expired:
+		return false, nil
+	}
+
+	select {
+	case <-expired:
+		return false, nil
+	default:
+		return true, p.err
+	}
+}
+
+// elapsed returns the wall-clock time the process has run, once it has exited.
+func (p *process) elapsed() time.Duration {
+	return p.end.Sub(p.start)
+}
+
+// exited reports whether the process has exited, without blocking.
+func (p *process) exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Version runs `xz --version` with the configured executable and returns the
+// version of XZ Utils, e.g. "5.4.1". If the executable cannot be found, the
+// error wraps ErrXZNotFound.
+func Version(ctx context.Context, opts ...Option) (string, error) {
+	if ctx == nil {
+		panic("nil Context")
+	}
+
+	o := defaultOptions()
+
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return "", err
+		}
+	}
+
+	var stdout bytes.Buffer
+
+	stderr := new(tailBuffer)
+	cmd := o.commandFunc(ctx, o.binary, "--version")
+	cmd.Stdout = &stdout
+	cmd.Stderr = o.stderr(stderr)
+
+	if err := cmd.Start(); err != nil {
+		return "", startError(o.binary, err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return "", waitError(ctx, err, stderr)
+	}
+
+	// The first line reads like "xz (XZ Utils) 5.4.1".
+	line, _ := bufio.NewReader(&stdout).ReadString('\n')
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("xzwriter: cannot parse version of %q: %q", o.binary, line)
+	}
+
+	return fields[len(fields)-1], nil
+}
+
+// selfTestPayload is compressed and decompressed by SelfTest.
+const selfTestPayload = "The quick brown fox jumps over the lazy dog.\n"
+
+// SelfTest checks that the configured executable works, by compressing and
+// decompressing a small payload and comparing the result. The options are
+// applied to both directions, like with NewWithOptions and
+// NewReaderWithOptions. It is meant to be called when a service starts, to
+// fail fast if xz is missing or broken.
+func SelfTest(ctx context.Context, opts ...Option) error {
+	payload := []byte(strings.Repeat(selfTestPayload, 64))
+
+	compressed, err := CompressBytes(ctx, payload, opts...)
+	if err != nil {
+		return fmt.Errorf("xzwriter: self-test: compress: %w", err)
+	}
+
+	decompressed, err := DecompressBytes(ctx, compressed, opts...)
+	if err != nil {
+		return fmt.Errorf("xzwriter: self-test: decompress: %w", err)
+	}
+
+	if !bytes.Equal(decompressed, payload) {
+		return fmt.Errorf("xzwriter: self-test: round trip of %d bytes returned %d different bytes",
+			len(payload), len(decompressed))
+	}
+
+	return nil
+}
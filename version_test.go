@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter_test
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"regexp"
+	"testing"
+
+	"github.com/jwkohnen/xzwriter"
+)
+
+func TestVersion(t *testing.T) {
+	_, err := xzwriter.Version(context.Background(), xzwriter.WithBinary("definitely-not-xz"))
+	if !errors.Is(err, xzwriter.ErrXZNotFound) {
+		t.Errorf("got %v, want ErrXZNotFound", err)
+	}
+
+	fake := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "sh", "-c", "echo 'xz (XZ Utils) 5.6.7'; echo 'liblzma 5.6.7'")
+	}
+
+	if v, err := xzwriter.Version(context.Background(), xzwriter.WithCommandFunc(fake)); err != nil || v != "5.6.7" {
+		t.Errorf("fake: Version() = %q, %v", v, err)
+	}
+
+	requireXZ(t)
+
+	v, err := xzwriter.Version(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !regexp.MustCompile(`^\d+\.\d+\.\d+`).MatchString(v) {
+		t.Errorf("Version() = %q", v)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	err := xzwriter.SelfTest(context.Background(), xzwriter.WithBinary("definitely-not-xz"))
+	if !errors.Is(err, xzwriter.ErrXZNotFound) {
+		t.Errorf("got %v, want ErrXZNotFound", err)
+	}
+
+	broken := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "sh", "-c", "cat >/dev/null")
+	}
+
+	if err := xzwriter.SelfTest(context.Background(), xzwriter.WithCommandFunc(broken)); err == nil {
+		t.Error("a broken executable has passed")
+	}
+
+	requireXZ(t)
+
+	if err := xzwriter.SelfTest(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
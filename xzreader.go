@@ -0,0 +1,481 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// XZReader is a ReadCloser that decompresses the reader it wraps through an
+// external XZ decompressor.
+type XZReader struct {
+	parent context.Context    // the context passed to the constructor
+	ctx    context.Context    // parent, possibly with the configured timeout
+	cancel context.CancelFunc // cancels ctx, nil if there is no timeout
+	cmd    *exec.Cmd
+	pipe   io.ReadCloser
+	opts   options
+	stderr *tailBuffer
+	closed bool
+
+	// copyBuf is the copy buffer of WriteTo, allocated on first use.
+	copyBuf []byte
+
+	// out is the number of bytes read so far, counted with WithMaxOutput.
+	out int64
+
+	// err is ErrOutputTooLarge once the limit of WithMaxOutput has been hit.
+	err error
+
+	// started is the time the process has been started.
+	started time.Time
+
+	// warning is the warning of xz tolerated with WithTolerateWarnings.
+	warning string
+
+	// eof is set once the output of xz has been read to the end.
+	eof bool
+
+	// stdin is the write end of the pipe to STDIN of xz that copySource
+	// feeds from the source, nil if xz reads the source directly.
+	stdin *os.File
+
+	// copied receives the result of copySource.
+	copied chan error
+}
+
+// NewReader returns an XZReader, decompressing the reader r.
+func NewReader(r io.Reader) (*XZReader, error) {
+	return NewReaderWithContext(context.Background(), r)
+}
+
+// NewReaderWithContext returns an XZReader, decompressing the reader r. The
+// context may be used to cancel or timeout the external decompressor process.
+//
+// The context can be used to kill the external process early. You still need to
+// call Close() to clean up ressources.
+func NewReaderWithContext(ctx context.Context, r io.Reader) (*XZReader, error) {
+	return NewReaderWithOptions(ctx, r)
+}
+
+// NewReaderWithOptions returns an XZReader, decompressing the reader r. The
+// context may be used to cancel or timeout the external decompressor process.
+//
+// The context can be used to kill the external process early. You still need to
+// call Close() to clean up ressources.
+//
+// The decompressor process can be configured with options. Options that only
+// concern compression, e.g. the compression level, are ignored.
+func NewReaderWithOptions(ctx context.Context, r io.Reader, opts ...Option) (*XZReader, error) {
+	if ctx == nil {
+		panic("nil Context")
+	}
+
+	xz, err := newReader(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := xz.open(r); err != nil {
+		return nil, err
+	}
+
+	return xz, nil
+}
+
+// Reset discards the state of the XZReader and starts a new decompressor
+// process that reads from r, with the options and the context the XZReader
+// has been created with. This allows reusing an XZReader, e.g. from a pool. The
+// previous stream must have been read until EOF and closed, otherwise Reset
+// returns ErrNotClosed.
+func (xz *XZReader) Reset(r io.Reader) error {
+	if xz == nil || xz.cmd == nil {
+		return ErrNotStarted
+	}
+
+	if !xz.closed {
+		return ErrNotClosed
+	}
+
+	xz.closed, xz.out, xz.err, xz.warning, xz.eof = false, 0, nil, "", false
+
+	if err := xz.open(r); err != nil {
+		// There is no process to close, so allow another Reset.
+		xz.closed = true
+
+		return err
+	}
+
+	return nil
+}
+
+// Test checks the integrity of the compressed stream r with `xz --test`, which
+// decompresses r without writing the result anywhere. It returns nil if the
+// stream is intact, otherwise an *XZError that tells what is wrong. The options
+// are applied like with NewReaderWithOptions.
+func Test(ctx context.Context, r io.Reader, opts ...Option) error {
+	if ctx == nil {
+		panic("nil Context")
+	}
+
+	xz, err := newReader(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	xz.prepare(r, "--test")
+
+	if err := xz.start(); err != nil {
+		return err
+	}
+
+	return xz.Close()
+}
+
+// newReader applies the options.
+func newReader(ctx context.Context, opts []Option) (*XZReader, error) {
+	xz := &XZReader{parent: ctx, opts: defaultOptions()}
+
+	for _, opt := range opts {
+		if err := opt(&xz.opts); err != nil {
+			return nil, err
+		}
+	}
+
+	return xz, nil
+}
+
+// open starts a decompressor process that reads from r.
+func (xz *XZReader) open(r io.Reader) error {
+	xz.prepare(r, "--decompress", "--stdout")
+
+	var err error
+	xz.pipe, err = xz.cmd.StdoutPipe()
+	if err != nil {
+		xz.cancelContext()
+
+		return err
+	}
+
+	return xz.start()
+}
+
+// prepare prepares the command that performs the operation on r.
+func (xz *XZReader) prepare(r io.Reader, operation ...string) {
+	xz.ctx, xz.cancel = xz.opts.commandContext(xz.parent)
+
+	xz.cmd = xz.opts.commandFunc(xz.ctx, xz.opts.binary, xz.compileArgs(operation)...)
+	xz.cmd.Stdin = r
+	xz.cmd.Dir = xz.opts.dir
+
+	xz.stderr = new(tailBuffer)
+	xz.cmd.Stderr = xz.opts.stderr(xz.stderr)
+
+	if xz.opts.sysProcAttr != nil {
+		xz.cmd.SysProcAttr = xz.opts.sysProcAttr
+	} else if xz.opts.separateProcessGroup {
+		xz.cmd.SysProcAttr = sysProcAttr()
+	}
+}
+
+// Warning returns the diagnostics of the warning that Close has tolerated
+// because of WithTolerateWarnings, or the empty string.
+func (xz *XZReader) Warning() string {
+	return xz.warning
+}
+
+// start starts the decompressor process.
+func (xz *XZReader) start() error {
+	xz.stdin, xz.copied = nil, nil
+
+	// The source is not copied by exec, because Wait would wait for the copy
+	// to finish, which never happens if the source blocks.
+	src := xz.cmd.Stdin
+	if _, ok := src.(*os.File); !ok && src != nil {
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			xz.cancelContext()
+
+			return err
+		}
+
+		// xz has its own copy of the read end once it has been started.
+		defer pr.Close()
+
+		xz.cmd.Stdin, xz.stdin = pr, pw
+	}
+
+	if err := xz.cmd.Start(); err != nil {
+		if xz.stdin != nil {
+			_ = xz.stdin.Close()
+		}
+
+		xz.cancelContext()
+
+		return startError(xz.opts.binary, err)
+	}
+
+	if xz.stdin != nil {
+		xz.copied = make(chan error, 1)
+		go copySource(xz.stdin, src, xz.copied)
+	}
+
+	xz.started = time.Now()
+	logStarted(xz.opts.logger, xz.cmd, xz.started)
+
+	return nil
+}
+
+// Read implements the io.Reader interface.
+func (xz *XZReader) Read(p []byte) (n int, err error) {
+	if xz.err != nil {
+		return 0, xz.err
+	}
+
+	limit := xz.opts.maxOutput
+	if limit == 0 {
+		n, err = xz.pipe.Read(p)
+		xz.eof = err == io.EOF
+
+		return n, err
+	}
+
+	// Read one byte more than allowed to tell whether the limit is exceeded.
+	if rest := limit - xz.out + 1; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+
+	n, err = xz.pipe.Read(p)
+	xz.out += int64(n)
+	xz.eof = err == io.EOF
+
+	if xz.out > limit {
+		n -= int(xz.out - limit)
+		xz.out = limit
+		xz.err = ErrOutputTooLarge
+		_ = xz.cmd.Process.Kill()
+
+		return n, xz.err
+	}
+
+	return n, err
+}
+
+// WriteTo implements the io.WriterTo interface. It copies the decompressed data
+// to w until EOF and returns the number of bytes copied. This lets io.Copy use
+// a buffer that is reused across calls.
+func (xz *XZReader) WriteTo(w io.Writer) (n int64, err error) {
+	if xz.copyBuf == nil {
+		xz.copyBuf = make([]byte, copyBufferSize)
+	}
+
+	for {
+		nr, errRead := xz.Read(xz.copyBuf)
+		if nr > 0 {
+			nw, errWrite := w.Write(xz.copyBuf[:nr])
+			n += int64(nw)
+
+			if errWrite != nil {
+				return n, errWrite
+			}
+
+			if nw != nr {
+				return n, io.ErrShortWrite
+			}
+		}
+
+		if errRead == io.EOF {
+			return n, nil
+		}
+
+		if errRead != nil {
+			return n, errRead
+		}
+	}
+}
+
+// Close implements the io.Closer interface. It waits for the decompressor
+// process to exit. If the process failed, the returned error is an *XZError. If
+// the process has been killed because the context is done, the error wraps the
+// error of the context, too. If the process has been killed because of
+// WithMaxOutput, the error is ErrOutputTooLarge.
+//
+// Closing the XZReader before reading it until EOF, e.g. once the caller has
+// found what it needs, closes the pipe from the process first, so that Close
+// does not wait for xz to write the rest of the data. The broken pipe that
+// makes xz exit is not reported, but an error the process has run into before
+// is.
+//
+// Close does not wait for a source that blocks, e.g. a connection that stays
+// open. If xz is still waiting for input after an early close, it is killed.
+// The goroutine reading such a source ends once its Read returns.
+//
+// Close is idempotent, subsequent calls return nil. Closing a nil or zero
+// XZReader returns ErrNotStarted.
+func (xz *XZReader) Close() error {
+	if xz == nil || xz.cmd == nil || xz.cmd.Process == nil {
+		return ErrNotStarted
+	}
+
+	if xz.closed {
+		return nil
+	}
+
+	xz.closed = true
+
+	// If the caller has stopped reading early, xz may be blocked writing to the
+	// full pipe, and Wait would never return. Closing the pipe makes xz fail
+	// with a broken pipe instead, which is not an error of the stream.
+	// If xz is blocked reading from a source that blocks instead, it never
+	// notices the closed pipe, so it is killed after closeGrace.
+	early := xz.pipe != nil && !xz.eof && xz.err == nil
+	var kill *time.Timer
+	if early {
+		_ = xz.pipe.Close()
+		kill = time.AfterFunc(closeGrace, func() { _ = xz.cmd.Process.Kill() })
+	}
+
+	errWait := xz.cmd.Wait()
+	logExited(xz.opts.logger, xz.cmd, xz.started)
+
+	if early && (isBrokenPipe(errWait, xz.stderr) || !kill.Stop() && isExitError(errWait)) {
+		errWait = nil
+	}
+
+	if errWait == nil {
+		errWait = xz.sourceError()
+	}
+
+	err := waitError(xz.ctx, errWait, xz.stderr)
+	xz.cancelContext()
+
+	if xz.opts.tolerateWarnings {
+		xz.warning, err = tolerateWarning(err)
+	}
+
+	if xz.err != nil {
+		return xz.err
+	}
+
+	return err
+}
+
+// closeGrace bounds how long Close waits for xz to exit after an early close.
+const closeGrace = 100 * time.Millisecond
+
+// copySource copies the source r to the pipe w to STDIN of xz, sends the
+// error of r to done and closes w.
+func copySource(w *os.File, r io.Reader, done chan<- error) {
+	_, err := io.Copy(w, r)
+
+	// xz stops reading after a single stream, and Close cuts the pipe after an
+	// early close. Neither is an error of the source.
+	if errors.Is(err, syscall.EPIPE) || errors.Is(err, os.ErrClosed) {
+		err = nil
+	}
+
+	done <- err
+	_ = w.Close()
+}
+
+// sourceError returns the error that copySource has run into, and cuts off
+// the source. It does not wait for a source that blocks, e.g. a connection
+// that stays open after the single stream that xz has read; the copy then
+// ends once the source returns.
+func (xz *XZReader) sourceError() error {
+	if xz.stdin == nil {
+		return nil
+	}
+
+	defer xz.stdin.Close()
+
+	select {
+	case err := <-xz.copied:
+		return err
+	default:
+		return nil
+	}
+}
+
+// isExitError reports whether err is the exit status of the process rather
+// than a failure of Wait itself.
+func isExitError(err error) bool {
+	var exitErr *exec.ExitError
+
+	return errors.As(err, &exitErr)
+}
+
+// cancelContext releases the resources of the derived context, if any.
+func (xz *XZReader) cancelContext() {
+	if xz.cancel != nil {
+		xz.cancel()
+	}
+}
+
+func (xz *XZReader) compileArgs(operation []string) []string {
+	args := append([]string(nil), operation...)
+
+	format := xz.opts.format
+	if format == "" {
+		format = FormatAuto
+	}
+
+	if xz.opts.storeOnly {
+		format = formatRaw
+	}
+
+	args = append(args, "--format="+string(format))
+
+	if xz.opts.storeOnly {
+		args = append(args, storeOnlyFilter)
+	}
+
+	if xz.opts.singleStream {
+		args = append(args, "--single-stream")
+	}
+
+	if xz.opts.memLimit != 0 {
+		args = append(args, "--memlimit-decompress="+strconv.FormatUint(xz.opts.memLimit, 10))
+	}
+
+	if xz.opts.threadsSet {
+		args = append(args, xz.opts.threadsArg())
+	}
+
+	switch {
+	case xz.opts.verboseWriter != nil:
+		args = append(args, "--verbose")
+	case !xz.opts.tolerateWarnings:
+		args = append(args, "--quiet")
+	}
+
+	args = append(args, xz.opts.extraArgs...)
+
+	return append(args, "--", "-")
+}
+
+var (
+	_ io.ReadCloser = (*XZReader)(nil) // assert
+	_ io.WriterTo   = (*XZReader)(nil) // assert
+)
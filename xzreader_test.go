@@ -0,0 +1,447 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jwkohnen/xzwriter"
+)
+
+func TestRoundTrip(t *testing.T) {
+	requireXZ(t)
+
+	for _, data := range [][]byte{nil, []byte("x"), text(1 << 20), random(300 << 10)} {
+		var buf bytes.Buffer
+
+		xz, err := xzwriter.New(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := xz.Write(data); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := xz.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := xzwriter.NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, data) {
+			t.Fatalf("got %d bytes, want %d bytes", len(got), len(data))
+		}
+	}
+}
+
+func TestReaderSingleStream(t *testing.T) {
+	requireXZ(t)
+
+	c := append(compress(t, []byte("first")), "trailing garbage"...)
+
+	if _, err := xzwriter.DecompressBytes(context.Background(), c); err == nil {
+		t.Error("trailing garbage has been accepted")
+	}
+
+	got, err := xzwriter.DecompressBytes(context.Background(), c, xzwriter.WithSingleStream())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "first" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestReaderConcatenated(t *testing.T) {
+	requireXZ(t)
+
+	c := append(compress(t, []byte("first ")), compress(t, []byte("second"))...)
+
+	got, err := xzwriter.DecompressBytes(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "first second" {
+		t.Errorf("got %q", got)
+	}
+
+	got, err = xzwriter.DecompressBytes(context.Background(), c, xzwriter.WithSingleStream())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "first " {
+		t.Errorf("single stream: got %q", got)
+	}
+}
+
+func TestTest(t *testing.T) {
+	requireXZ(t)
+
+	c := compress(t, random(64<<10))
+
+	if err := xzwriter.Test(context.Background(), bytes.NewReader(c)); err != nil {
+		t.Fatal(err)
+	}
+
+	c[len(c)/2] ^= 0x10
+
+	var xzErr *xzwriter.XZError
+	if err := xzwriter.Test(context.Background(), bytes.NewReader(c)); !errors.As(err, &xzErr) {
+		t.Fatalf("got %v, want an *XZError", err)
+	}
+
+	if xzErr.Stderr == "" || !strings.Contains(xzErr.Error(), strings.TrimSpace(xzErr.Stderr)) {
+		t.Errorf("no diagnostics in %v", xzErr)
+	}
+}
+
+func TestReaderWriteTo(t *testing.T) {
+	requireXZ(t)
+
+	data := text(1 << 20)
+
+	r, err := xzwriter.NewReader(bytes.NewReader(compress(t, data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	n, err := r.WriteTo(&buf)
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("WriteTo() = %d, %v", n, err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Error("the data differs")
+	}
+}
+
+func TestReaderMemLimit(t *testing.T) {
+	requireXZ(t)
+	t.Setenv("LC_ALL", "C") // ErrMemLimit matches the English diagnostics
+
+	c := compress(t, text(1<<10), xzwriter.WithCompressLevel(xzwriter.Best))
+
+	_, err := xzwriter.DecompressBytes(context.Background(), c, xzwriter.WithMemLimit(xzwriter.MinMemLimit))
+	if !errors.Is(err, xzwriter.ErrMemLimit) {
+		t.Fatalf("got %v, want ErrMemLimit", err)
+	}
+
+	var xzErr *xzwriter.XZError
+	if !errors.As(err, &xzErr) {
+		t.Errorf("got %v, want an *XZError", err)
+	}
+
+	if _, err := xzwriter.DecompressBytes(context.Background(), c); errors.Is(err, xzwriter.ErrMemLimit) {
+		t.Errorf("got %v without a limit", err)
+	}
+}
+
+func TestReaderMaxOutput(t *testing.T) {
+	requireXZ(t)
+
+	c := compress(t, text(4<<20))
+
+	r, err := xzwriter.NewReaderWithOptions(context.Background(), bytes.NewReader(c), xzwriter.WithMaxOutput(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := io.Copy(io.Discard, r)
+	if !errors.Is(err, xzwriter.ErrOutputTooLarge) {
+		t.Errorf("got %v, want ErrOutputTooLarge", err)
+	}
+
+	if n != 1<<20 {
+		t.Errorf("read %d bytes, want %d", n, 1<<20)
+	}
+
+	if err := r.Close(); !errors.Is(err, xzwriter.ErrOutputTooLarge) {
+		t.Errorf("Close: got %v, want ErrOutputTooLarge", err)
+	}
+
+	// A stream of exactly the limit passes.
+	got, err := xzwriter.DecompressBytes(context.Background(), c, xzwriter.WithMaxOutput(4<<20))
+	if err != nil || len(got) != 4<<20 {
+		t.Errorf("at the limit: got %d bytes, %v", len(got), err)
+	}
+
+	_, err = xzwriter.NewReaderWithOptions(context.Background(), bytes.NewReader(c), xzwriter.WithMaxOutput(0))
+	if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+		t.Errorf("got %v, want ErrOptionIllegal", err)
+	}
+}
+
+func TestReaderFormat(t *testing.T) {
+	requireXZ(t)
+
+	c := compress(t, []byte("legacy"), xzwriter.WithFormat(xzwriter.FormatLZMA))
+
+	got, err := xzwriter.DecompressBytes(context.Background(), c)
+	if err != nil || string(got) != "legacy" {
+		t.Errorf("auto: got %q, %v", got, err)
+	}
+
+	got, err = xzwriter.DecompressBytes(context.Background(), c, xzwriter.WithFormat(xzwriter.FormatAuto))
+	if err != nil || string(got) != "legacy" {
+		t.Errorf("FormatAuto: got %q, %v", got, err)
+	}
+
+	if _, err := xzwriter.DecompressBytes(context.Background(), c, xzwriter.WithFormat(xzwriter.FormatXZ)); err == nil {
+		t.Error("FormatXZ has accepted an .lzma stream")
+	}
+}
+
+func TestReaderThreads(t *testing.T) {
+	requireXZ(t)
+
+	data := text(2 << 20)
+	c := compress(t, data, xzwriter.WithCompressLevel(xzwriter.Fast), xzwriter.WithBlockSize(512<<10))
+
+	got, err := xzwriter.DecompressBytes(context.Background(), c, xzwriter.WithThreads(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Error("the data differs")
+	}
+}
+
+func TestReaderReset(t *testing.T) {
+	var zero xzwriter.XZReader
+	if err := zero.Reset(bytes.NewReader(nil)); !errors.Is(err, xzwriter.ErrNotStarted) {
+		t.Errorf("zero value: got %v, want ErrNotStarted", err)
+	}
+
+	requireXZ(t)
+
+	r, err := xzwriter.NewReader(bytes.NewReader(compress(t, []byte("first"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Reset(bytes.NewReader(nil)); !errors.Is(err, xzwriter.ErrNotClosed) {
+		t.Fatalf("got %v, want ErrNotClosed", err)
+	}
+
+	for _, want := range []string{"first", "second"} {
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(got) != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+
+		if err := r.Reset(bytes.NewReader(compress(t, []byte("second")))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_ = r.Close()
+}
+
+func TestReaderTruncated(t *testing.T) {
+	requireXZ(t)
+	t.Setenv("LC_ALL", "C") // ErrTruncated matches the English diagnostics
+
+	c := compress(t, random(256<<10))
+
+	_, err := xzwriter.DecompressBytes(context.Background(), c[:len(c)/2])
+	if !errors.Is(err, xzwriter.ErrTruncated) {
+		t.Fatalf("got %v, want ErrTruncated", err)
+	}
+
+	if errors.Is(err, xzwriter.ErrCorrupt) {
+		t.Errorf("%v matches ErrCorrupt, too", err)
+	}
+}
+
+func TestReaderCorrupt(t *testing.T) {
+	requireXZ(t)
+	t.Setenv("LC_ALL", "C") // ErrCorrupt matches the English diagnostics
+
+	c := compress(t, random(256<<10))
+	c[len(c)/2] ^= 0x10
+
+	_, err := xzwriter.DecompressBytes(context.Background(), c)
+	if !errors.Is(err, xzwriter.ErrCorrupt) {
+		t.Fatalf("got %v, want ErrCorrupt", err)
+	}
+
+	if errors.Is(err, xzwriter.ErrTruncated) {
+		t.Errorf("%v matches ErrTruncated, too", err)
+	}
+}
+
+func TestReaderEarlyClose(t *testing.T) {
+	fake := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "cat")
+	}
+
+	r, err := xzwriter.NewReaderWithOptions(context.Background(), bytes.NewReader(text(64<<20)),
+		xzwriter.WithCommandFunc(fake))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(r, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Errorf("got %v, want no error for the broken pipe", err)
+	}
+
+	requireXZ(t)
+
+	c := compress(t, text(64<<20), xzwriter.WithCompressLevel(1))
+
+	r, err = xzwriter.NewReader(bytes.NewReader(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(r, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Errorf("xz: got %v, want no error for the broken pipe", err)
+	}
+}
+
+// blockingReader blocks in Read until the test has finished, like a
+// connection that stays open without sending anything.
+type blockingReader chan struct{}
+
+func (b blockingReader) Read([]byte) (int, error) {
+	<-b
+
+	return 0, io.EOF
+}
+
+func newBlockingReader(t *testing.T) blockingReader {
+	t.Helper()
+
+	b := make(blockingReader)
+	t.Cleanup(func() { close(b) })
+
+	return b
+}
+
+func TestReaderBlockingSource(t *testing.T) {
+	run := func(t *testing.T, src io.Reader, read int, opts ...xzwriter.Option) {
+		t.Helper()
+
+		r, err := xzwriter.NewReaderWithOptions(context.Background(), src, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var rerr error
+		if read < 0 {
+			_, rerr = io.ReadAll(r)
+		} else {
+			_, rerr = io.ReadFull(r, make([]byte, read))
+		}
+
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+
+		done := make(chan error, 1)
+		go func() { done <- r.Close() }()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("got %v, want no error", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Close hangs on a blocking source")
+		}
+	}
+
+	t.Run("exited", func(t *testing.T) {
+		line := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+			return exec.CommandContext(ctx, "sh", "-c", `read -r line; echo "$line"`)
+		}
+
+		src := io.MultiReader(strings.NewReader("hello\n"), newBlockingReader(t))
+		run(t, src, -1, xzwriter.WithCommandFunc(line))
+	})
+
+	t.Run("waiting for input", func(t *testing.T) {
+		fake := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+			return exec.CommandContext(ctx, "cat")
+		}
+
+		src := io.MultiReader(strings.NewReader("hello"), newBlockingReader(t))
+		run(t, src, 5, xzwriter.WithCommandFunc(fake))
+	})
+
+	t.Run("xz", func(t *testing.T) {
+		requireXZ(t)
+
+		c := compress(t, text(1<<20))
+
+		// xz fills its input buffer before it decodes, so the stream is
+		// followed by more than a buffer of trailing garbage.
+		src := io.MultiReader(bytes.NewReader(c), bytes.NewReader(make([]byte, 64<<10)), newBlockingReader(t))
+		run(t, src, -1, xzwriter.WithSingleStream())
+
+		c = compress(t, random(1<<20))
+
+		src = io.MultiReader(bytes.NewReader(c[:len(c)/2]), newBlockingReader(t))
+		run(t, src, 1024)
+	})
+}
@@ -15,26 +15,140 @@
  */
 
 // Package xzwriter provides a WriteCloser XZWriter that pipes through an
-// external XZ compressor.
+// external XZ compressor and a ReadCloser XZReader that pipes through an
+// external XZ decompressor.
 //
 // Expects the Tukaani XZ tool in $PATH. See the XZ Utils home page:
 // <http://tukaani.org/xz/>
+//
+// The environment variable XZWRITER_BINARY may name a different executable,
+// unless one is configured with WithBinary.
+//
+// Both types are used like the readers and writers of compress/gzip:
+//
+//	f, err := os.Create("data.xz")
+//	if err != nil {
+//		return err
+//	}
+//	defer f.Close()
+//
+//	w, err := xzwriter.New(f)
+//	if err != nil {
+//		return err
+//	}
+//	if _, err := w.Write(data); err != nil {
+//		_ = w.Close()
+//		return err
+//	}
+//	if err := w.Close(); err != nil {
+//		return err
+//	}
+//
+//	if _, err := f.Seek(0, io.SeekStart); err != nil {
+//		return err
+//	}
+//
+//	r, err := xzwriter.NewReader(f)
+//	if err != nil {
+//		return err
+//	}
+//	if _, err := io.Copy(os.Stdout, r); err != nil {
+//		_ = r.Close()
+//		return err
+//	}
+//	return r.Close()
 package xzwriter
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
 )
 
 // XZWriter is a WriteCloser that wraps a writer around an XZ compressor.
 type XZWriter struct {
-	cmd  *exec.Cmd
-	pipe io.WriteCloser
-	opts options
+	in     int64 // accessed atomically, first for alignment
+	out    *countingWriter
+	dst    io.Writer // the destination, out.w unless WithOutputWrapper is used
+	ctx    context.Context
+	cmdCtx context.Context    // ctx, possibly with the configured timeout
+	cancel context.CancelFunc // cancels cmdCtx, nil if cmdCtx is ctx
+	cmd    *exec.Cmd
+	proc   *process
+	pipe   io.WriteCloser
+	opts   options
+	stderr *tailBuffer
+	closed int32 // accessed atomically
+
+	// lastProgress is the input count at the last progress report.
+	lastProgress int64
+
+	// streamStart is the input count at the start of the current stream.
+	streamStart int64
+
+	// outStart is the output count at the start of the current stream.
+	outStart int64
+
+	// bw buffers writes to the pipe, unless buffering is disabled.
+	bw *bufio.Writer
+
+	// copyBuf is the copy buffer of ReadFrom, allocated on first use.
+	copyBuf []byte
+
+	// started is the time the XZWriter has been started or reset.
+	started time.Time
+
+	// result is populated by Close.
+	result Result
+
+	// warning is the last warning of xz tolerated with WithTolerateWarnings.
+	warning string
+
+	// elapsed is the run time of the processes of the finished streams.
+	elapsed time.Duration
+
+	// blocks is the number of blocks of the finished streams, or -1 if it is
+	// unknown.
+	blocks int
+
+	// index is the index of the last finished stream, unless errIndex is set.
+	index    Index
+	errIndex error
+}
+
+// Result summarizes a closed XZWriter.
+type Result struct {
+	// BytesIn is the number of uncompressed bytes written to the XZWriter.
+	BytesIn int64
+
+	// BytesOut is the number of compressed bytes written to the destination.
+	BytesOut int64
+
+	// Ratio is BytesOut divided by BytesIn, as reported by `xz --list`, or 0
+	// if nothing has been written.
+	Ratio float64
+
+	// Duration is the time between starting the XZWriter and the end of
+	// Close.
+	Duration time.Duration
 }
 
+// progressInterval is the number of bytes written between two progress reports.
+const progressInterval = 1 << 20
+
+// copyBufferSize is the buffer size of ReadFrom, the capacity of a Linux pipe.
+const copyBufferSize = 64 << 10
+
 // New returns an XZWriter, wrapping the writer w.
 func New(w io.Writer) (*XZWriter, error) {
 	return NewWithContext(context.Background(), w)
@@ -63,59 +177,751 @@ func NewWithOptions(ctx context.Context, w io.Writer, opts ...Option) (*XZWriter
 		panic("nil Context")
 	}
 
-	xz := XZWriter{
-		// default options
-		opts: options{
-			compressLevel: Default,
-		},
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	xz := &XZWriter{ctx: ctx, opts: o}
+
+	if err := xz.start(w); err != nil {
+		return nil, err
 	}
 
-	for _, opt := range opts {
-		if err := opt(&xz); err != nil {
-			return nil, err
+	return xz, nil
+}
+
+// Reset lets a closed XZWriter compress to the writer w, by starting a new
+// compressor process with the same context and options. Calling Reset on an
+// XZWriter that has not been closed is an error.
+func (xz *XZWriter) Reset(w io.Writer) error {
+	if atomic.LoadInt32(&xz.closed) == 0 {
+		return ErrNotClosed
+	}
+
+	return xz.start(w)
+}
+
+// start starts the compressor process, writing to w.
+func (xz *XZWriter) start(w io.Writer) error {
+	xz.out = new(countingWriter)
+
+	if err := xz.setDestination(w); err != nil {
+		return err
+	}
+
+	return xz.startFresh()
+}
+
+// setDestination makes w the destination of xz.out.
+func (xz *XZWriter) setDestination(w io.Writer) error {
+	if s, ok := w.(io.Seeker); ok && xz.opts.appendMode {
+		if _, err := s.Seek(0, io.SeekEnd); err != nil {
+			return fmt.Errorf("xzwriter: cannot seek to the end of the destination: %w", err)
 		}
 	}
 
-	xz.cmd = exec.CommandContext(ctx, "xz", xz.compileArgs()...)
-	xz.cmd.Stdout = w
+	xz.dst, xz.out.w = w, w
+	if xz.opts.outputWrapper != nil {
+		xz.out.w = xz.opts.outputWrapper(w)
+	}
 
-	if xz.opts.verboseWriter != nil {
-		xz.cmd.Stderr = xz.opts.verboseWriter
+	xz.out.limit = xz.opts.maxCompressed
+
+	switch {
+	case xz.opts.indexWriter != nil:
+		xz.out.tail = &indexTail{max: largeIndexTail}
+	case xz.opts.blockCount && xz.opts.format != FormatLZMA && !xz.opts.storeOnly:
+		xz.out.tail = &indexTail{max: smallIndexTail}
 	}
 
-	if xz.opts.separateProcessGroup {
-		xz.cmd.SysProcAttr = sysProcAttr()
+	if d, ok := w.(writeDeadliner); ok && xz.opts.writeDeadline > 0 {
+		xz.out.deadliner, xz.out.deadline = d, xz.opts.writeDeadline
 	}
 
-	var err error
-	xz.pipe, err = xz.cmd.StdinPipe()
+	return nil
+}
+
+// startFresh resets the counters and starts the first stream.
+func (xz *XZWriter) startFresh() error {
+	atomic.StoreInt64(&xz.in, 0)
+	xz.lastProgress = 0
+	xz.started = time.Now()
+	xz.result = Result{}
+	xz.warning = ""
+	xz.elapsed = 0
+	xz.blocks = 0
+
+	if xz.opts.hash != nil {
+		xz.opts.hash.Reset()
+	}
+
+	return xz.startStream()
+}
+
+// startStream starts a compressor process that writes a new stream to the
+// destination.
+func (xz *XZWriter) startStream() error {
+	xz.stderr = new(tailBuffer)
+
+	// The pipe is not created with StdinPipe, because Wait would close it
+	// behind our back once the process has exited.
+	pr, pw, err := os.Pipe()
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	xz.cmdCtx, xz.cancel = xz.opts.commandContext(xz.ctx)
+	xz.outStart = atomic.LoadInt64(&xz.out.n)
+
+	if xz.useFallback() {
+		err = xz.startFallback(pr)
+	} else {
+		err = xz.spawn(pr, pw)
 	}
 
-	err = xz.cmd.Start()
 	if err != nil {
-		return nil, err
+		_ = pw.Close()
+		xz.cancelContext()
+
+		return err
+	}
+
+	xz.pipe = pw
+
+	switch {
+	case xz.opts.bufferSize == 0:
+		xz.bw = nil
+	case xz.bw == nil:
+		xz.bw = bufio.NewWriterSize(xz.pipe, xz.opts.bufferSize)
+	default:
+		xz.bw.Reset(xz.pipe)
+	}
+
+	xz.streamStart = atomic.LoadInt64(&xz.in)
+	atomic.StoreInt32(&xz.closed, 0)
+
+	activateLeakCheck(xz)
+
+	return nil
+}
+
+// spawn starts the external compressor process, reading from stdin. The
+// process gets its own copy of stdin, so it is closed in any case. pipe is the
+// other end of stdin, which a graceful cancellation closes.
+func (xz *XZWriter) spawn(stdin, pipe *os.File) error {
+	err := xz.startWithRetry(stdin, pipe)
+	_ = stdin.Close()
+
+	if err != nil {
+		return startError(xz.opts.binary, err)
+	}
+
+	if xz.opts.niceSet {
+		if err := setPriority(xz.cmd.Process.Pid, xz.opts.nice); err != nil {
+			_ = xz.cmd.Process.Kill()
+			_ = xz.proc.wait()
+
+			return fmt.Errorf("xzwriter: cannot set priority: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// startWithRetry starts the compressor process, retrying with a fresh command
+// as configured with WithSpawnRetry while starting fails with EAGAIN.
+func (xz *XZWriter) startWithRetry(stdin, pipe *os.File) error {
+	backoff := xz.opts.spawnBackoff
+
+	for attempt := 1; ; attempt++ {
+		var err error
+		xz.cmd = xz.command(stdin, pipe)
+		xz.proc, err = startProcess(xz.cmd, xz.opts.logger)
+
+		if err == nil || attempt >= xz.opts.spawnAttempts || !errors.Is(err, syscall.EAGAIN) {
+			return err
+		}
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-xz.cmdCtx.Done():
+			t.Stop()
+
+			return err
+		}
+
+		backoff *= 2
+	}
+}
+
+// command creates the command of the compressor process.
+func (xz *XZWriter) command(stdin, pipe *os.File) *exec.Cmd {
+	cmd := xz.opts.commandFunc(xz.cmdCtx, xz.opts.binary, xz.compileArgs()...)
+	cmd.Stdout = xz.out
+	cmd.Dir = xz.opts.dir
+
+	// If xz reads a file, the pipe is left unconnected, so that writes fail
+	// rather than block.
+	if !xz.opts.readsInputFile() {
+		cmd.Stdin = stdin
+	}
+
+	cmd.Stderr = xz.opts.stderr(xz.stderr)
+
+	if xz.opts.sysProcAttr != nil {
+		cmd.SysProcAttr = xz.opts.sysProcAttr
+	} else if xz.opts.separateProcessGroup {
+		cmd.SysProcAttr = sysProcAttr()
+	}
+
+	if timeout := xz.opts.gracefulCancel; timeout > 0 {
+		cmd.Cancel = func() error {
+			_ = pipe.Close()
+
+			// Killing a process that has been waited for is a no-op.
+			time.AfterFunc(timeout, func() { _ = cmd.Process.Kill() })
+
+			return nil
+		}
 	}
 
-	return &xz, err
+	return cmd
 }
 
-// Write implements the io.Writer interface.
+// Write implements the io.Writer interface. After Close it returns ErrClosed.
+// A large p, e.g. a memory-mapped file, is passed to the process in chunks
+// without being copied. If the process has died, e.g. because of an invalid
+// option, the error wraps the *XZError that tells why, as well as the broken
+// pipe.
 func (xz *XZWriter) Write(p []byte) (n int, err error) {
-	return xz.pipe.Write(p)
+	if atomic.LoadInt32(&xz.closed) != 0 {
+		return 0, ErrClosed
+	}
+
+	if xz.proc == nil {
+		return 0, ErrNotStarted
+	}
+
+	if err := xz.out.failure(); err != nil {
+		return 0, err
+	}
+
+	// A large p is written in chunks of the size of a pipe buffer, straight
+	// from p, so the counters and the progress keep up with the process.
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > copyBufferSize {
+			chunk = chunk[:copyBufferSize]
+		}
+
+		nw, err := xz.writeChunk(chunk)
+		n += nw
+		p = p[nw:]
+
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
 }
 
-// Close implements the io.Closer interface.
+// exitGrace bounds how long pipeError waits for xz to be reaped. A broken pipe
+// is reported as soon as xz has closed its end, which may be a moment before
+// Wait returns.
+const exitGrace = 100 * time.Millisecond
+
+// pipeError explains an error writing to the pipe: xz dies of a broken pipe
+// once the destination has failed, and if xz has exited otherwise, e.g.
+// because of an invalid option, its exit status and diagnostics tell why.
+func (xz *XZWriter) pipeError(err error) error {
+	if errDst := xz.out.failure(); errDst != nil {
+		return errDst
+	}
+
+	if !errors.Is(err, syscall.EPIPE) && !errors.Is(err, io.ErrClosedPipe) {
+		return err
+	}
+
+	t := time.NewTimer(exitGrace)
+	defer t.Stop()
+
+	select {
+	case <-xz.proc.done:
+	case <-t.C:
+		return err
+	}
+
+	if xz.proc.err == nil {
+		return err
+	}
+
+	return fmt.Errorf("xzwriter: xz has exited: %w: %w", waitError(xz.cmdCtx, xz.proc.err, xz.stderr), err)
+}
+
+// writeChunk writes p to the buffer or the pipe and updates the counters.
+func (xz *XZWriter) writeChunk(p []byte) (n int, err error) {
+	if xz.bw != nil {
+		n, err = xz.bw.Write(p)
+	} else {
+		n, err = xz.pipe.Write(p)
+	}
+
+	if err != nil {
+		err = xz.pipeError(err)
+	}
+
+	if xz.opts.hash != nil {
+		_, _ = xz.opts.hash.Write(p[:n])
+	}
+
+	in := atomic.AddInt64(&xz.in, int64(n))
+
+	if xz.opts.progress != nil && in-xz.lastProgress >= progressInterval {
+		xz.lastProgress = in
+		xz.opts.progress(xz.Stats())
+	}
+
+	return n, err
+}
+
+// WriteString implements the io.StringWriter interface. It writes s like Write
+// does, but without copying s into a byte slice first.
+func (xz *XZWriter) WriteString(s string) (n int, err error) {
+	// The bytes are neither modified nor retained, so it is safe to alias s.
+	return xz.Write(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// WriteContext writes p like Write does, but returns early with the error of
+// ctx once ctx is done, even if Write is blocked because the destination
+// stalls. To unblock Write, the compressor process is killed, so the stream is
+// unusable after an aborted write and the XZWriter should be closed. Note that
+// Close waits for pending writes to the destination, so it still blocks while
+// the destination stalls.
+func (xz *XZWriter) WriteContext(ctx context.Context, p []byte) (n int, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if ctx.Done() == nil {
+		return xz.Write(p)
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+		n, err := xz.Write(p)
+		done <- result{n, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.n, r.err
+	case <-ctx.Done():
+	}
+
+	xz.abort()
+
+	// Wait for Write to return, so it does not race with the caller.
+	r := <-done
+
+	return r.n, ctx.Err()
+}
+
+// abort unblocks a pending write by killing the compressor process, or by
+// closing the pipe to the in-process fallback.
+func (xz *XZWriter) abort() {
+	if xz.cmd == nil {
+		_ = xz.pipe.Close()
+
+		return
+	}
+
+	if !xz.proc.exited() {
+		_ = xz.cmd.Process.Kill()
+	}
+}
+
+// ReadFrom implements the io.ReaderFrom interface. It copies r to the compressor
+// process until EOF and returns the number of uncompressed bytes copied. This
+// lets io.Copy use a buffer that is reused across calls.
+func (xz *XZWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	if xz.copyBuf == nil {
+		xz.copyBuf = make([]byte, copyBufferSize)
+	}
+
+	for {
+		nr, errRead := r.Read(xz.copyBuf)
+		if nr > 0 {
+			nw, errWrite := xz.Write(xz.copyBuf[:nr])
+			n += int64(nw)
+
+			if errWrite != nil {
+				return n, errWrite
+			}
+		}
+
+		if errRead == io.EOF {
+			return n, nil
+		}
+
+		if errRead != nil {
+			return n, errRead
+		}
+	}
+}
+
+// Flush writes the data buffered so far to the compressor process, see
+// WithBufferSize.
+//
+// Note that xz buffers its input itself and emits compressed data lazily.  If
+// the data is supposed to reach the destination before Close, e.g. when
+// compressing a log in near-real-time, configure WithFlushTimeout: xz then
+// flushes its buffers once the input has been idle for the timeout.
+//
+// With WithStreamPerFlush, Flush finishes the current stream instead, and
+// starts a new one for the data written afterwards.
+func (xz *XZWriter) Flush() error {
+	if atomic.LoadInt32(&xz.closed) != 0 {
+		return ErrClosed
+	}
+
+	if xz.opts.streamPerFlush {
+		return xz.rotateStream()
+	}
+
+	return xz.flush()
+}
+
+// rotateStream finishes the current stream and starts a new one, unless
+// nothing has been written to the current stream.
+func (xz *XZWriter) rotateStream() error {
+	if atomic.LoadInt64(&xz.in) == xz.streamStart {
+		return nil
+	}
+
+	deactivateLeakCheck(xz)
+
+	err := xz.finishStream()
+	if err == nil {
+		err = xz.startStream()
+	}
+
+	if err != nil {
+		atomic.StoreInt32(&xz.closed, 1)
+	}
+
+	return err
+}
+
+func (xz *XZWriter) flush() error {
+	if xz.bw == nil {
+		return nil
+	}
+
+	return xz.bw.Flush()
+}
+
+// Sync flushes the write buffer like Flush does without WithStreamPerFlush,
+// and commits what the compressor process has written to the destination so
+// far to stable storage, if the destination has a Sync method like *os.File.
+// Otherwise that step is skipped.
+//
+// Sync does not make xz emit the data it has buffered internally, see Flush.
+func (xz *XZWriter) Sync() error {
+	if atomic.LoadInt32(&xz.closed) != 0 {
+		return ErrClosed
+	}
+
+	// Unlike Flush, it does not finish the stream with WithStreamPerFlush.
+	if err := xz.flush(); err != nil {
+		return err
+	}
+
+	if s, ok := xz.dst.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+
+	return nil
+}
+
+// Close implements the io.Closer interface. It waits for the compressor process
+// to exit. If the process failed, the returned error is an *XZError. If the
+// process has been killed because the context is done, the error wraps the
+// error of the context, too. If flushing or closing the pipe failed, the errors
+// are joined. With WithCloseDestination, Close closes the destination after the
+// process has exited, after closing the wrapper of WithOutputWrapper if it is
+// an io.Closer. With WithCloseTimeout, Close kills a process that has not
+// exited in time and returns ErrCloseTimeout.
+//
+// Close is idempotent, subsequent calls return nil. Closing a nil or zero
+// XZWriter returns ErrNotStarted.
 func (xz *XZWriter) Close() error {
+	if xz == nil || xz.proc == nil {
+		return ErrNotStarted
+	}
+
+	if !atomic.CompareAndSwapInt32(&xz.closed, 0, 1) {
+		return nil
+	}
+
+	deactivateLeakCheck(xz)
+
+	err := xz.finishStream()
+
+	if err == nil && xz.opts.indexWriter != nil {
+		err = xz.writeIndex()
+	}
+
+	if c, ok := xz.out.w.(io.Closer); ok && xz.opts.outputWrapper != nil {
+		err = errors.Join(err, c.Close())
+	}
+
+	if xz.opts.closeDestination {
+		if c, ok := xz.dst.(io.Closer); ok {
+			err = errors.Join(err, c.Close())
+		}
+	}
+
+	xz.result = xz.newResult()
+
+	if xz.opts.progress != nil {
+		xz.opts.progress(xz.Stats())
+	}
+
+	return err
+}
+
+func (xz *XZWriter) newResult() Result {
+	in, out := xz.Stats()
+	r := Result{BytesIn: in, BytesOut: out, Duration: time.Since(xz.started)}
+
+	if in > 0 {
+		r.Ratio = float64(out) / float64(in)
+	}
+
+	return r
+}
+
+// Elapsed returns the wall-clock time the compressor process has run, from
+// its start until it has exited, which is final after Close. With
+// WithStreamPerFlush it is the sum over all processes. Unlike
+// Result.Duration, it does not include starting the process and the work of
+// Close after the process has exited. Together with Stats it tells the
+// throughput of xz.
+func (xz *XZWriter) Elapsed() time.Duration {
+	return xz.elapsed
+}
+
+// Sum returns the digest of the uncompressed data computed by the hash
+// configured with WithHash, or nil if there is none. The digest is final after
+// Close.
+func (xz *XZWriter) Sum() []byte {
+	if xz.opts.hash == nil {
+		return nil
+	}
+
+	return xz.opts.hash.Sum(nil)
+}
+
+// Warning returns the diagnostics of the last warning that Close has tolerated
+// because of WithTolerateWarnings, or the empty string.
+func (xz *XZWriter) Warning() string {
+	return xz.warning
+}
+
+// Result returns the summary of the XZWriter after Close has returned, or the
+// zero Result before. Unlike Stats, Result must not be called concurrently
+// with Close.
+func (xz *XZWriter) Result() Result {
+	return xz.result
+}
+
+// finishStream closes the pipe to the compressor process and waits for it to
+// exit after writing the rest of the stream.
+func (xz *XZWriter) finishStream() error {
+	expired, stop := xz.closeTimer()
+	defer stop()
+
+	errFlush := xz.flush()
 	errPipe := xz.pipe.Close()
 
-	errWait := xz.cmd.Wait()
-	if errWait != nil {
-		return errWait
+	ok, errProc := xz.proc.waitUntil(expired)
+	if !ok {
+		xz.cancelContext()
+		xz.blocks = -1
+
+		return ErrCloseTimeout
 	}
 
-	return errPipe
+	errWait := waitError(xz.cmdCtx, errProc, xz.stderr)
+	xz.elapsed += xz.proc.elapsed()
+
+	if xz.opts.tolerateWarnings {
+		var warning string
+		if warning, errWait = tolerateWarning(errWait); warning != "" {
+			xz.warning = warning
+		}
+	}
+
+	// After a graceful cancellation the pipe has been closed already, and Wait
+	// returns the error of the context even if xz succeeded.
+	if xz.cmdCtx.Err() != nil && xz.cmd != nil && xz.opts.gracefulCancel > 0 {
+		if errors.Is(errFlush, os.ErrClosed) {
+			errFlush = nil
+		}
+
+		if errors.Is(errPipe, os.ErrClosed) {
+			errPipe = nil
+		}
+	}
+
+	xz.cancelContext()
+
+	// The process has likely failed because the destination failed, and the
+	// pipe is broken as a consequence.
+	if errDst := xz.out.failure(); errDst != nil && errWait != nil {
+		errWait = errDst
+
+		if errors.Is(errFlush, syscall.EPIPE) {
+			errFlush = nil
+		}
+
+		if errors.Is(errPipe, syscall.EPIPE) {
+			errPipe = nil
+		}
+	}
+
+	err := errors.Join(errWait, errFlush, errPipe)
+	if err != nil {
+		xz.blocks = -1
+	} else {
+		xz.readIndex()
+	}
+
+	return err
+}
+
+// readIndex parses the index of the finished stream and counts its blocks.
+func (xz *XZWriter) readIndex() {
+	if xz.out.tail == nil {
+		xz.blocks = -1
+
+		return
+	}
+
+	xz.index, xz.errIndex = parseIndex(xz.out.tail.buf, atomic.LoadInt64(&xz.out.n)-xz.outStart)
+
+	switch {
+	case xz.errIndex != nil:
+		xz.blocks = -1
+	case xz.blocks >= 0:
+		xz.blocks += len(xz.index.Blocks)
+	}
+}
+
+// BlockCount returns the number of .xz blocks written, which is final after
+// Close: one for a stream written in a single block, more in multi-threaded
+// mode or with WithBlockSize, and the sum over all streams with
+// WithStreamPerFlush. The blocks are counted only with WithBlockCount or
+// WithIndexWriter. It returns -1 if the number is unknown, because the blocks
+// are not counted, a stream has failed, the format has no blocks, e.g. with
+// WithStoreOnly, or the index is too large to be kept; that happens only
+// beyond some 5,000 blocks, unless WithIndexWriter is used.
+func (xz *XZWriter) BlockCount() int {
+	return xz.blocks
+}
+
+// closeTimer starts the timer of WithCloseTimeout, if any, that kills the
+// compressor process, and the function to stop it. The returned channel is
+// closed once the process has been killed; it is nil without a timeout.
+func (xz *XZWriter) closeTimer() (expired <-chan struct{}, stop func()) {
+	if xz.opts.closeTimeout <= 0 || xz.cmd == nil {
+		return nil, func() {}
+	}
+
+	c := make(chan struct{})
+	proc := xz.proc
+
+	t := time.AfterFunc(xz.opts.closeTimeout, func() {
+		if proc.exited() {
+			return
+		}
+
+		close(c)
+		_ = proc.cmd.Process.Kill()
+	})
+
+	return c, func() { t.Stop() }
+}
+
+// writeIndex writes the index of the finished stream to the index writer.
+func (xz *XZWriter) writeIndex() error {
+	if xz.errIndex != nil {
+		return xz.errIndex
+	}
+
+	if err := json.NewEncoder(xz.opts.indexWriter).Encode(xz.index); err != nil {
+		return fmt.Errorf("xzwriter: cannot write the index: %w", err)
+	}
+
+	return nil
+}
+
+// cancelContext releases the resources of the derived context, if any.
+func (xz *XZWriter) cancelContext() {
+	if xz.cancel != nil {
+		xz.cancel()
+	}
+}
+
+// Stats returns the number of uncompressed bytes written to the XZWriter and the
+// number of compressed bytes the compressor process wrote to the destination so
+// far. The numbers are final after Close. Stats is safe to call concurrently.
+func (xz *XZWriter) Stats() (in, out int64) {
+	return atomic.LoadInt64(&xz.in), atomic.LoadInt64(&xz.out.n)
+}
+
+// PID returns the process ID of the compressor process, or -1 if the process
+// has exited or the in-process fallback is used. PID is safe to call
+// concurrently with Write and Close, but not with Reset or, with
+// WithStreamPerFlush, Flush, which replace the process.
+func (xz *XZWriter) PID() int {
+	if xz.cmd == nil || xz.proc.exited() {
+		return -1
+	}
+
+	return xz.cmd.Process.Pid
+}
+
+// UsedFallback reports whether the XZWriter compresses with the in-process
+// fallback instead of the xz executable, see WithFallback.
+func (xz *XZWriter) UsedFallback() bool {
+	return xz.proc != nil && xz.cmd == nil
+}
+
+// Args returns a copy of the command line of the compressor process, including
+// the executable as the first element, or nil if the in-process fallback is
+// used.
+func (xz *XZWriter) Args() []string {
+	if xz.cmd == nil {
+		return nil
+	}
+
+	return append([]string(nil), xz.cmd.Args...)
+}
+
+// Done returns a channel that is closed when the compressor process has exited,
+// be it after Close, because of a failure or because the context is done.
+func (xz *XZWriter) Done() <-chan struct{} {
+	return xz.proc.done
 }
 
 func (xz *XZWriter) compileArgs() []string {
@@ -123,17 +929,210 @@ func (xz *XZWriter) compileArgs() []string {
 
 	args := []string{"--compress", "--stdout", compressLevel}
 
+	switch {
+	case xz.opts.storeOnly:
+		args = append(args, "--format="+string(formatRaw))
+	case xz.opts.format != "":
+		args = append(args, "--format="+string(xz.opts.format))
+	}
+
 	if xz.opts.extreme {
 		args = append(args, "--extreme")
 	}
 
-	if xz.opts.verboseWriter != nil {
+	args = append(args, xz.filterArgs()...)
+
+	if xz.opts.threadsSet {
+		args = append(args, xz.opts.threadsArg())
+	}
+
+	if xz.opts.blockSize > 0 {
+		args = append(args, "--block-size="+strconv.FormatUint(xz.opts.blockSize, 10))
+	}
+
+	switch {
+	case xz.opts.check != "":
+		args = append(args, "--check="+string(xz.opts.check))
+	case xz.opts.reproducible && xz.opts.format != FormatLZMA:
+		args = append(args, "--check="+string(CheckCRC64))
+	}
+
+	if xz.opts.memLimit > 0 {
+		args = append(args, "--memlimit-compress="+strconv.FormatUint(xz.opts.memLimit, 10))
+	}
+
+	if xz.opts.strictMemory {
+		args = append(args, "--no-adjust")
+	}
+
+	if xz.opts.flushTimeout > 0 {
+		args = append(args, "--flush-timeout="+strconv.FormatInt(xz.opts.flushTimeout.Milliseconds(), 10))
+	}
+
+	switch {
+	case xz.opts.verboseWriter != nil:
 		args = append(args, "--verbose")
-	} else {
+	case !xz.opts.tolerateWarnings:
 		args = append(args, "--quiet")
 	}
 
-	return append(args, "--", "-")
+	args = append(args, xz.opts.extraArgs...)
+
+	return append(args, xz.opts.inputArgs()...)
+}
+
+// countingWriter counts the bytes written to the underlying writer.  It
+// records the first error of the underlying writer, including a short write
+// that the writer failed to report, so Write and Close can return it instead
+// of the broken pipe that xz dies of.
+type countingWriter struct {
+	n      int64 // accessed atomically, first for alignment
+	w      io.Writer
+	err    error // valid once failed is set
+	failed int32 // accessed atomically
+
+	// limit is the budget configured with WithMaxCompressed, if any.
+	limit int64
+
+	// ready, if not nil, is closed once w has been set by a Pool.
+	ready chan struct{}
+
+	// deadliner is w, if a write deadline is configured and w supports it.
+	deadliner writeDeadliner
+	deadline  time.Duration
+
+	// tail keeps the end of the stream for WithIndexWriter or WithBlockCount,
+	// if configured.
+	tail *indexTail
+}
+
+// writeDeadliner is implemented by destinations like net.Conn.
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.ready != nil {
+		<-c.ready
+	}
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	if c.deadliner != nil {
+		if err := c.deadliner.SetWriteDeadline(time.Now().Add(c.deadline)); err != nil {
+			return 0, c.fail(err)
+		}
+	}
+
+	var errQuota error
+	if c.limit > 0 && c.n+int64(len(p)) > c.limit {
+		p = p[:c.limit-c.n]
+		errQuota = ErrQuotaExceeded
+	}
+
+	n, err := c.w.Write(p)
+	atomic.AddInt64(&c.n, int64(n))
+
+	if c.tail != nil {
+		_, _ = c.tail.Write(p[:n])
+	}
+
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+
+	if err == nil {
+		err = errQuota
+	}
+
+	if err != nil {
+		return n, c.fail(err)
+	}
+
+	return n, nil
+}
+
+// fail records err as the failure of the destination.
+func (c *countingWriter) fail(err error) error {
+	c.err = err
+	atomic.StoreInt32(&c.failed, 1)
+
+	return err
+}
+
+// failure returns the error of the destination, or nil if it has not failed.
+// It is safe to call concurrently with Write.
+func (c *countingWriter) failure() error {
+	if atomic.LoadInt32(&c.failed) == 0 {
+		return nil
+	}
+
+	if c.err == ErrQuotaExceeded {
+		return c.err
+	}
+
+	return fmt.Errorf("xzwriter: destination: %w", c.err)
 }
 
-var _ io.WriteCloser = (*XZWriter)(nil) // assert
+// filterArgs returns the arguments of a custom filter chain, if the options
+// require one. The chains of WithStoreOnly and WithFilterChain are used as
+// is. Otherwise, as a custom chain replaces the preset, the chain ends with an
+// LZMA2 filter, or LZMA1 for the .lzma format, that is configured with the
+// preset.
+func (xz *XZWriter) filterArgs() []string {
+	if xz.opts.storeOnly {
+		return []string{storeOnlyFilter}
+	}
+
+	if xz.opts.filterChain != nil {
+		return xz.opts.filterChain
+	}
+
+	if xz.opts.bcj == "" && xz.opts.deltaDistance == 0 && xz.opts.dictSize == 0 {
+		return nil
+	}
+
+	var args []string
+
+	if xz.opts.bcj != "" {
+		args = append(args, "--"+string(xz.opts.bcj))
+	}
+
+	if xz.opts.deltaDistance != 0 {
+		args = append(args, "--delta=dist="+strconv.Itoa(xz.opts.deltaDistance))
+	}
+
+	preset := strconv.Itoa(xz.opts.compressLevel)
+	if xz.opts.extreme {
+		preset += "e"
+	}
+
+	lzma := "--lzma2=preset=" + preset
+	if xz.opts.format == FormatLZMA {
+		lzma = "--lzma1=preset=" + preset
+	}
+
+	if xz.opts.dictSize != 0 {
+		lzma += ",dict=" + strconv.FormatUint(xz.opts.dictSize, 10)
+	}
+
+	return append(args, lzma)
+}
+
+// WriteFlushCloser is the subset of the methods of XZWriter that code writing a
+// compressed stream usually needs. Accept a WriteFlushCloser rather than an
+// *XZWriter to be able to substitute a fake in tests, or another compressor
+// like *gzip.Writer.
+type WriteFlushCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+var (
+	_ io.WriteCloser   = (*XZWriter)(nil) // assert
+	_ io.ReaderFrom    = (*XZWriter)(nil) // assert
+	_ io.StringWriter  = (*XZWriter)(nil) // assert
+	_ WriteFlushCloser = (*XZWriter)(nil) // assert
+)
@@ -0,0 +1,1594 @@
+/*
+ * Copyright (c) 2021 Johannes Kohnen <jwkohnen-github@ko-sys.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xzwriter_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jwkohnen/xzwriter"
+)
+
+func TestNewWithOptions(t *testing.T) {
+	requireXZ(t)
+
+	data := text(256 << 10)
+
+	var buf bytes.Buffer
+
+	xz, err := xzwriter.New(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := xz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertRoundTrip(t, buf.Bytes(), data)
+	assertRoundTrip(t, compress(t, data, xzwriter.WithCompressLevel(xzwriter.Fast), xzwriter.WithExtreme(true)), data)
+}
+
+func TestIllegalOption(t *testing.T) {
+	for _, l := range []int{xzwriter.Fast - 1, xzwriter.Best + 1} {
+		_, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithCompressLevel(l))
+		if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+			t.Errorf("level %d: got %v, want ErrOptionIllegal", l, err)
+		}
+	}
+}
+
+func TestThreads(t *testing.T) {
+	requireXZ(t)
+
+	// At level 0, xz splits the input into blocks of 768 KiB in
+	// multi-threaded mode.
+	data := text(3 << 20)
+
+	for _, n := range []int{0, 1, 2} {
+		c := compress(t, data, xzwriter.WithCompressLevel(xzwriter.Fast), xzwriter.WithThreads(n))
+		assertRoundTrip(t, c, data)
+
+		if streams := bytes.Count(c, []byte("\xfd7zXZ\x00")); streams != 1 {
+			t.Errorf("%d threads: %d streams, want 1", n, streams)
+		}
+	}
+
+	_, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithThreads(-1))
+	if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+		t.Errorf("got %v, want ErrOptionIllegal", err)
+	}
+}
+
+func TestBinary(t *testing.T) {
+	requireXZ(t)
+
+	path, err := exec.LookPath("xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := text(64 << 10)
+	assertRoundTrip(t, compress(t, data, xzwriter.WithBinary(path)), data)
+
+	_, err = xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithBinary("definitely-not-xz"))
+	if err == nil {
+		t.Error("a missing executable has been started")
+	}
+
+	_, err = xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithBinary(""))
+	if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+		t.Errorf("got %v, want ErrOptionIllegal", err)
+	}
+}
+
+func TestFlushTimeout(t *testing.T) {
+	requireXZ(t)
+
+	r, w := io.Pipe()
+	defer r.Close()
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), w, xzwriter.WithFlushTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := xz.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	read := make(chan error, 1)
+
+	go func() {
+		_, err := r.Read(make([]byte, 1024))
+		read <- err
+	}()
+
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no output before Close")
+	}
+
+	go func() { _, _ = io.Copy(io.Discard, r) }()
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithFlushTimeout(time.Microsecond))
+	if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+		t.Errorf("got %v, want ErrOptionIllegal", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	requireXZ(t)
+
+	var buf bytes.Buffer
+
+	xz, err := xzwriter.New(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := text(1 << 20)
+	if _, err := xz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	in, out := xz.Stats()
+	if in != int64(len(data)) || out != int64(buf.Len()) {
+		t.Errorf("Stats() = %d, %d, want %d, %d", in, out, len(data), buf.Len())
+	}
+
+	if out >= in {
+		t.Errorf("%d bytes of text compressed to %d bytes", in, out)
+	}
+
+	res := xz.Result()
+	if res.BytesIn != in || res.BytesOut != out || res.Duration <= 0 {
+		t.Errorf("Result() = %+v", res)
+	}
+
+	if want := float64(out) / float64(in); res.Ratio != want {
+		t.Errorf("ratio %v, want %v", res.Ratio, want)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	requireXZ(t)
+
+	var calls, lastIn, lastOut int64
+
+	progress := func(in, out int64) {
+		calls++
+		lastIn, lastOut = in, out
+	}
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithProgress(progress))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := text(3 << 20)
+	for len(data) > 0 {
+		n := 64 << 10
+		if _, err := xz.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+
+		data = data[n:]
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls < 3 {
+		t.Errorf("%d calls, want at least 3", calls)
+	}
+
+	if in, out := xz.Stats(); lastIn != in || lastOut != out {
+		t.Errorf("last call with %d, %d, want the Stats() %d, %d", lastIn, lastOut, in, out)
+	}
+
+	// A nil callback is a no-op.
+	compress(t, text(3<<20), xzwriter.WithProgress(nil))
+}
+
+func TestCloseReportsKilledProcess(t *testing.T) {
+	requireXZ(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	xz, err := xzwriter.NewWithContext(ctx, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+
+	// Once the process has been killed, writing to it fails.
+	for i := 0; i < 1000; i++ {
+		if _, err := xz.Write(text(64 << 10)); err != nil {
+			break
+		}
+	}
+
+	var exitErr *exec.ExitError
+	if err := xz.Close(); !errors.As(err, &exitErr) || exitErr.ExitCode() != -1 {
+		t.Errorf("got %v, want the exit error of the killed process", err)
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+	requireXZ(t)
+
+	var buf bytes.Buffer
+
+	xz, err := xzwriter.New(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := text(1 << 20)
+
+	n, err := io.Copy(xz, bytes.NewReader(data))
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("io.Copy() = %d, %v", n, err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertRoundTrip(t, buf.Bytes(), data)
+
+	errRead := errors.New("read failed")
+
+	xz, err = xzwriter.New(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := xz.ReadFrom(io.MultiReader(bytes.NewReader(data), errReader{errRead})); !errors.Is(err, errRead) {
+		t.Errorf("got %v, want the error of the reader", err)
+	}
+
+	_ = xz.Close()
+}
+
+type errReader struct{ err error }
+
+func (e errReader) Read([]byte) (int, error) { return 0, e.err }
+
+func TestWriteString(t *testing.T) {
+	requireXZ(t)
+
+	var buf bytes.Buffer
+
+	xz, err := xzwriter.New(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := io.WriteString(xz, "hello, "); err != nil || n != 7 {
+		t.Fatalf("WriteString() = %d, %v", n, err)
+	}
+
+	if _, err := xz.WriteString(""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := xz.WriteString("world"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertRoundTrip(t, buf.Bytes(), []byte("hello, world"))
+}
+
+func TestReset(t *testing.T) {
+	requireXZ(t)
+
+	var first, second bytes.Buffer
+
+	xz, err := xzwriter.New(&first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := xz.Write([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Reset(&second); !errors.Is(err, xzwriter.ErrNotClosed) {
+		t.Fatalf("got %v, want ErrNotClosed", err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Reset(&second); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := xz.Write([]byte("second")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertRoundTrip(t, first.Bytes(), []byte("first"))
+	assertRoundTrip(t, second.Bytes(), []byte("second"))
+
+	if in, out := xz.Stats(); in != 6 || out != int64(second.Len()) {
+		t.Errorf("Stats() after Reset = %d, %d, want %d, %d", in, out, 6, second.Len())
+	}
+}
+
+func TestPID(t *testing.T) {
+	requireXZ(t)
+
+	xz, err := xzwriter.New(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan int)
+
+	go func() { done <- xz.PID() }()
+
+	if _, err := xz.Write(text(64 << 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	if pid := <-done; pid <= 0 || pid != xz.PID() {
+		t.Errorf("PID() = %d, then %d", pid, xz.PID())
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if xz.PID() != -1 {
+		t.Errorf("PID() after Close = %d", xz.PID())
+	}
+}
+
+func TestCommandFuncFake(t *testing.T) {
+	var buf bytes.Buffer
+
+	fake := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "cat")
+	}
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), &buf, xzwriter.WithCommandFunc(fake))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := xz.Write([]byte("not compressed")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "not compressed" {
+		t.Fatalf("got %q", buf.String())
+	}
+
+	_, err = xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithCommandFunc(nil))
+	if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+		t.Errorf("got %v, want ErrOptionIllegal", err)
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	requireXZ(t)
+
+	data := text(64 << 10)
+
+	for _, size := range []int{0, 1, 7, xzwriter.DefaultBufferSize} {
+		var buf bytes.Buffer
+
+		xz, err := xzwriter.NewWithOptions(context.Background(), &buf, xzwriter.WithBufferSize(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for p := data; len(p) > 0; p = p[1:] {
+			if _, err := xz.Write(p[:1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := xz.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		assertRoundTrip(t, buf.Bytes(), data)
+	}
+
+	_, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithBufferSize(-1))
+	if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+		t.Errorf("got %v, want ErrOptionIllegal", err)
+	}
+}
+
+// syncBuffer is a destination that counts the calls of Sync.
+type syncBuffer struct {
+	bytes.Buffer
+	syncs int
+}
+
+func (b *syncBuffer) Sync() error {
+	b.syncs++
+
+	return nil
+}
+
+func TestSync(t *testing.T) {
+	requireXZ(t)
+
+	var buf syncBuffer
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := xz.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.syncs != 1 {
+		t.Errorf("destination synced %d times, want 1", buf.syncs)
+	}
+
+	assertRoundTrip(t, buf.Bytes(), []byte("data"))
+}
+
+func TestDone(t *testing.T) {
+	exit := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "true")
+	}
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithCommandFunc(exit))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-xz.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Done is not closed after the process has exited")
+	}
+
+	if xz.PID() != -1 {
+		t.Errorf("PID() = %d after the process has exited", xz.PID())
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	requireXZ(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	xz, err := xzwriter.NewWithContext(ctx, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	<-xz.Done()
+
+	if err := xz.Close(); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	requireXZ(t)
+
+	xz, err := xzwriter.New(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	if _, err := xz.Write([]byte("data")); !errors.Is(err, xzwriter.ErrClosed) {
+		t.Errorf("Write: got %v, want ErrClosed", err)
+	}
+
+	if err := xz.Flush(); !errors.Is(err, xzwriter.ErrClosed) {
+		t.Errorf("Flush: got %v, want ErrClosed", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	slow := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "sleep", "10")
+	}
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard,
+		xzwriter.WithCommandFunc(slow), xzwriter.WithTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+
+	if err := xz.Close(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Close took %v", d)
+	}
+
+	_, err = xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithTimeout(0))
+	if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+		t.Errorf("got %v, want ErrOptionIllegal", err)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	slow := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "sleep", "10")
+	}
+
+	// The earlier of the deadline and the timeout applies.
+	xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithCommandFunc(slow),
+		xzwriter.WithTimeout(time.Hour), xzwriter.WithDeadline(time.Now().Add(50*time.Millisecond)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+
+	if err := xz.Close(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Close took %v", d)
+	}
+
+	_, err = xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithDeadline(time.Time{}))
+	if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+		t.Errorf("got %v, want ErrOptionIllegal", err)
+	}
+}
+
+func TestStreamPerFlush(t *testing.T) {
+	requireXZ(t)
+
+	var buf bytes.Buffer
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), &buf, xzwriter.WithStreamPerFlush())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := xz.Write([]byte("first ")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	cut := buf.Len()
+
+	if _, err := xz.Write([]byte("second")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertRoundTrip(t, buf.Bytes(), []byte("first second"))
+	assertRoundTrip(t, buf.Bytes()[:cut], []byte("first "))
+}
+
+func TestSyncKeepsStream(t *testing.T) {
+	requireXZ(t)
+
+	var buf syncBuffer
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), &buf, xzwriter.WithStreamPerFlush())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pid := xz.PID()
+
+	if _, err := xz.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if xz.PID() != pid || buf.syncs != 1 {
+		t.Errorf("Sync has rotated the stream or not synced the destination: PID %d, then %d, %d syncs",
+			pid, xz.PID(), buf.syncs)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Sync(); !errors.Is(err, xzwriter.ErrClosed) {
+		t.Errorf("got %v, want ErrClosed", err)
+	}
+}
+
+func TestWriterArgs(t *testing.T) {
+	requireXZ(t)
+
+	for _, tc := range []struct {
+		opts []xzwriter.Option
+		want string
+	}{
+		{nil, "xz"},
+		{[]xzwriter.Option{xzwriter.WithArgs("--block-size=1MiB")}, "--block-size=1MiB"},
+		{[]xzwriter.Option{xzwriter.WithDeltaFilter(4)}, "--delta=dist=4 --lzma2=preset=6"},
+		{[]xzwriter.Option{xzwriter.WithBCJFilter(xzwriter.BCJX86)}, "--x86 --lzma2=preset=6"},
+		{[]xzwriter.Option{xzwriter.WithDictSize(12 << 20)}, "--lzma2=preset=6,dict=12582912"},
+		{[]xzwriter.Option{xzwriter.WithFilterChain("x86 lzma2=preset=6")}, "--x86 --lzma2=preset=6"},
+		{[]xzwriter.Option{xzwriter.WithReproducible()}, "--check=crc64"},
+		{[]xzwriter.Option{xzwriter.WithReproducible()}, "--threads=1"},
+	} {
+		xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, tc.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		args := xz.Args()
+		if joined := strings.Join(args, " "); !strings.Contains(joined, tc.want) {
+			t.Errorf("args %q lack %q", joined, tc.want)
+		}
+
+		// The result is a copy.
+		args[0] = "changed"
+		if xz.Args()[0] == "changed" {
+			t.Error("Args returns the command line itself")
+		}
+
+		if err := xz.Close(); err != nil {
+			t.Errorf("%q: %v", tc.want, err)
+		}
+	}
+}
+
+func TestZeroValue(t *testing.T) {
+	var xz *xzwriter.XZWriter
+	if err := xz.Close(); !errors.Is(err, xzwriter.ErrNotStarted) {
+		t.Errorf("nil: got %v, want ErrNotStarted", err)
+	}
+
+	if _, err := new(xzwriter.XZWriter).Write([]byte("x")); !errors.Is(err, xzwriter.ErrNotStarted) {
+		t.Errorf("zero: got %v, want ErrNotStarted", err)
+	}
+
+	var r *xzwriter.XZReader
+	if err := r.Close(); !errors.Is(err, xzwriter.ErrNotStarted) {
+		t.Errorf("nil reader: got %v, want ErrNotStarted", err)
+	}
+}
+
+// recordingCloser is a destination that appends its name to a log when it is
+// closed, so that tests can check how often and in which order closers are
+// closed.
+type recordingCloser struct {
+	bytes.Buffer
+	name string
+	log  *[]string
+
+	// lenAtClose is the number of bytes written before the last Close.
+	lenAtClose int
+}
+
+func (c *recordingCloser) Close() error {
+	*c.log = append(*c.log, c.name)
+	c.lenAtClose = c.Len()
+
+	return nil
+}
+
+func TestCloseDestination(t *testing.T) {
+	requireXZ(t)
+
+	var log []string
+
+	dst := &recordingCloser{name: "destination", log: &log}
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), dst, xzwriter.WithCloseDestination())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := xz.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := xz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if strings.Join(log, " ") != "destination" {
+		t.Errorf("closed %q, want the destination once", log)
+	}
+
+	// The destination is closed after the compressor has written everything.
+	if dst.lenAtClose != dst.Len() {
+		t.Errorf("closed after %d of %d bytes", dst.lenAtClose, dst.Len())
+	}
+
+	assertRoundTrip(t, dst.Bytes(), []byte("data"))
+
+	log = nil
+
+	xz, err = xzwriter.NewWithOptions(context.Background(), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(log) != 0 {
+		t.Errorf("closed %q without WithCloseDestination", log)
+	}
+}
+
+func TestHash(t *testing.T) {
+	requireXZ(t)
+
+	data := text(1 << 20)
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithHash(sha256.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := xz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := sha256.Sum256(data); !bytes.Equal(xz.Sum(), want[:]) {
+		t.Errorf("Sum() = %x, want %x", xz.Sum(), want)
+	}
+
+	if err := xz.Reset(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := sha256.Sum256(nil); !bytes.Equal(xz.Sum(), want[:]) {
+		t.Errorf("Sum() after Reset = %x, want %x", xz.Sum(), want)
+	}
+
+	xz, err = xzwriter.New(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if sum := xz.Sum(); sum != nil {
+		t.Errorf("Sum() = %x without a hash", sum)
+	}
+}
+
+func TestWriteContext(t *testing.T) {
+	r, w := io.Pipe()
+	defer r.Close()
+
+	fake := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "cat")
+	}
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), w, xzwriter.WithCommandFunc(fake))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := xz.WriteContext(context.Background(), []byte("data")); n != 4 || err != nil {
+		t.Fatalf("WriteContext() = %d, %v", n, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// Nobody reads the destination, so the pipes fill up and the write stalls.
+	_, err = xz.WriteContext(ctx, text(4<<20))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+
+	go func() { _, _ = io.Copy(io.Discard, r) }()
+
+	_ = xz.Close()
+}
+
+func TestShortWrite(t *testing.T) {
+	requireXZ(t)
+
+	xz, err := xzwriter.New(shortWriter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = xz.Write(random(1 << 20))
+
+	if err := xz.Close(); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("got %v, want io.ErrShortWrite", err)
+	}
+}
+
+// shortWriter is a destination that violates io.Writer by reporting a short
+// write without an error.
+type shortWriter struct{}
+
+func (shortWriter) Write(p []byte) (int, error) { return len(p) / 2, nil }
+
+func TestGracefulCancel(t *testing.T) {
+	requireXZ(t)
+
+	data := text(256 << 10)
+
+	cancelAfterWrite := func(opts ...xzwriter.Option) []byte {
+		t.Helper()
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var buf bytes.Buffer
+
+		xz, err := xzwriter.NewWithOptions(ctx, &buf, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := xz.Write(data); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := xz.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		cancel()
+		<-xz.Done()
+
+		if err := xz.Close(); !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, want context.Canceled", err)
+		}
+
+		return buf.Bytes()
+	}
+
+	// xz finishes the stream with everything written before the cancellation.
+	assertRoundTrip(t, cancelAfterWrite(xzwriter.WithGracefulCancel(5*time.Second)), data)
+
+	// Without the option xz is killed while it waits for more input, so the
+	// stream lacks at least its end.
+	if _, err := xzwriter.DecompressBytes(context.Background(), cancelAfterWrite()); err == nil {
+		t.Error("the stream of a killed xz decodes")
+	}
+
+	_, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithGracefulCancel(0))
+	if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+		t.Errorf("got %v, want ErrOptionIllegal", err)
+	}
+}
+
+func TestWriteDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	fake := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "cat")
+	}
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), client,
+		xzwriter.WithCommandFunc(fake), xzwriter.WithWriteDeadline(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody reads from the server, so the first write to the client times
+	// out.
+	_, _ = xz.Write(text(1 << 20))
+
+	var netErr net.Error
+	if err := xz.Close(); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("got %v, want a timeout", err)
+	}
+
+	_, err = xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithWriteDeadline(0))
+	if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+		t.Errorf("got %v, want ErrOptionIllegal", err)
+	}
+}
+
+func TestMaxCompressed(t *testing.T) {
+	var buf bytes.Buffer
+
+	fake := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "cat")
+	}
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), &buf,
+		xzwriter.WithCommandFunc(fake), xzwriter.WithMaxCompressed(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The output of cat is as large as its input, so it exceeds the budget
+	// soon, but it takes a while until Write notices.
+	for i := 0; i < 1000; i++ {
+		if _, err = xz.Write(text(64 << 10)); err != nil {
+			break
+		}
+	}
+
+	if !errors.Is(err, xzwriter.ErrQuotaExceeded) {
+		t.Errorf("Write: got %v, want ErrQuotaExceeded", err)
+	}
+
+	if err := xz.Close(); !errors.Is(err, xzwriter.ErrQuotaExceeded) {
+		t.Errorf("Close: got %v, want ErrQuotaExceeded", err)
+	}
+
+	if buf.Len() != 4096 {
+		t.Errorf("destination got %d bytes, want 4096", buf.Len())
+	}
+
+	_, err = xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithMaxCompressed(0))
+	if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+		t.Errorf("WithMaxCompressed(0): got %v, want ErrOptionIllegal", err)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	fake := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "cat")
+	}
+
+	events := make(chan xzwriter.LifecycleEvent, 2)
+	logger := xzwriter.WithLogger(func(e xzwriter.LifecycleEvent) { events <- e })
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithCommandFunc(fake), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pid := xz.PID()
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	started, exited := <-events, <-events
+	if started.Kind != xzwriter.EventStarted || started.PID != pid {
+		t.Errorf("started: %+v", started)
+	}
+
+	if exited.Kind != xzwriter.EventExited || exited.ExitCode != 0 || exited.Duration <= 0 {
+		t.Errorf("exited: %+v", exited)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sleep := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "sleep", "10")
+	}
+
+	xz, err = xzwriter.NewWithOptions(ctx, io.Discard, xzwriter.WithCommandFunc(sleep), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if started := <-events; started.Kind != xzwriter.EventStarted {
+		t.Errorf("started: %+v", started)
+	}
+
+	cancel()
+
+	if killed := <-events; killed.Kind != xzwriter.EventKilled || killed.ExitCode != -1 {
+		t.Errorf("killed: %+v", killed)
+	}
+
+	_ = xz.Close()
+}
+
+type errWriter struct{ err error }
+
+func (e errWriter) Write([]byte) (int, error) { return 0, e.err }
+
+func TestDestinationError(t *testing.T) {
+	errDst := errors.New("destination failed")
+
+	fake := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "cat")
+	}
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), errWriter{errDst}, xzwriter.WithCommandFunc(fake))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if _, err = xz.Write(text(64 << 10)); err != nil {
+			break
+		}
+	}
+
+	if !errors.Is(err, errDst) {
+		t.Errorf("Write: got %v, want the error of the destination", err)
+	}
+
+	err = xz.Close()
+	if !errors.Is(err, errDst) {
+		t.Errorf("Close: got %v, want the error of the destination", err)
+	}
+
+	if errors.Is(err, syscall.EPIPE) {
+		t.Errorf("Close: got %v, want no broken pipe", err)
+	}
+}
+
+func TestTolerateWarnings(t *testing.T) {
+	warn := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "sh", "-c", "cat; echo 'xz: something odd' >&2; exit 2")
+	}
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithCommandFunc(warn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var xzErr *xzwriter.XZError
+	if err := xz.Close(); !errors.As(err, &xzErr) || xzErr.ExitCode() != xzwriter.ExitCodeWarning {
+		t.Fatalf("got %v, want an *XZError with the warning exit code", err)
+	}
+
+	xz, err = xzwriter.NewWithOptions(context.Background(), io.Discard,
+		xzwriter.WithCommandFunc(warn), xzwriter.WithTolerateWarnings())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(xz.Warning(), "something odd") {
+		t.Errorf("Warning() = %q", xz.Warning())
+	}
+}
+
+func TestLargeWrite(t *testing.T) {
+	var buf bytes.Buffer
+
+	fake := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "cat")
+	}
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), &buf, xzwriter.WithCommandFunc(fake))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := random(8 << 20)
+
+	if n, err := xz.Write(data); err != nil || n != len(data) {
+		t.Fatalf("Write() = %d, %v", n, err)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("got %d bytes, want the %d bytes written", buf.Len(), len(data))
+	}
+}
+
+func TestAppend(t *testing.T) {
+	requireXZ(t)
+
+	name := filepath.Join(t.TempDir(), "data.xz")
+
+	for _, s := range []string{"first ", "second"} {
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		xz, err := xzwriter.NewWithOptions(context.Background(), f, xzwriter.WithAppend())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := xz.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := xz.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertRoundTrip(t, c, []byte("first second"))
+}
+
+func TestElapsed(t *testing.T) {
+	slow := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "sh", "-c", "cat >/dev/null; sleep 0.1")
+	}
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithCommandFunc(slow))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d := xz.Elapsed(); d != 0 {
+		t.Errorf("before Close: Elapsed() = %v, want 0", d)
+	}
+
+	if err := xz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := xz.Elapsed(); d < 100*time.Millisecond || d > 5*time.Second {
+		t.Errorf("Elapsed() = %v, want about 100ms", d)
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	hang := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "sleep", "10")
+	}
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard,
+		xzwriter.WithCommandFunc(hang), xzwriter.WithCloseTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+
+	if err := xz.Close(); !errors.Is(err, xzwriter.ErrCloseTimeout) {
+		t.Errorf("got %v, want ErrCloseTimeout", err)
+	}
+
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Close took %v", d)
+	}
+
+	_, err = xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithCloseTimeout(0))
+	if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+		t.Errorf("got %v, want ErrOptionIllegal", err)
+	}
+}
+
+func TestReproducible(t *testing.T) {
+	for name, opt := range map[string]xzwriter.Option{
+		"flush timeout": xzwriter.WithFlushTimeout(time.Second),
+		"threads":       xzwriter.WithThreads(4),
+		"fallback":      xzwriter.WithFallback(),
+	} {
+		if err := xzwriter.ValidateOptions(xzwriter.WithReproducible(), opt); !errors.Is(err, xzwriter.ErrOptionIllegal) {
+			t.Errorf("%s: got %v, want ErrOptionIllegal", name, err)
+		}
+	}
+
+	requireXZ(t)
+
+	data := random(2 << 20)
+
+	a := compress(t, data, xzwriter.WithReproducible())
+	b := compress(t, data, xzwriter.WithReproducible())
+
+	if !bytes.Equal(a, b) {
+		t.Error("the outputs differ")
+	}
+}
+
+// xorWriter inverts the bits of the data it writes to w and records its Close
+// in log.
+type xorWriter struct {
+	w   io.Writer
+	log *[]string
+}
+
+func (x xorWriter) Write(p []byte) (int, error) {
+	q := make([]byte, len(p))
+	for i, b := range p {
+		q[i] = b ^ 0xff
+	}
+
+	return x.w.Write(q)
+}
+
+func (x xorWriter) Close() error {
+	*x.log = append(*x.log, "wrapper")
+
+	return nil
+}
+
+func TestOutputWrapper(t *testing.T) {
+	fake := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "cat")
+	}
+
+	var log []string
+
+	dst := &recordingCloser{name: "destination", log: &log}
+	wrap := func(w io.Writer) io.Writer { return xorWriter{w: w, log: &log} }
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), dst, xzwriter.WithCommandFunc(fake),
+		xzwriter.WithOutputWrapper(wrap), xzwriter.WithCloseDestination())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := text(64 << 10)
+	if _, err := xz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := xz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The wrapper is closed once, before the destination.
+	if got := strings.Join(log, " "); got != "wrapper destination" {
+		t.Errorf("closed %q, want the wrapper and then the destination", got)
+	}
+
+	got := dst.Bytes()
+	for i := range got {
+		got[i] ^= 0xff
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Error("the destination did not get the data through the wrapper")
+	}
+
+	if _, out := xz.Stats(); out != int64(len(data)) {
+		t.Errorf("Stats() counts %d bytes out, want %d", out, len(data))
+	}
+
+	_, err = xzwriter.NewWithOptions(context.Background(), io.Discard, xzwriter.WithOutputWrapper(nil))
+	if !errors.Is(err, xzwriter.ErrOptionIllegal) {
+		t.Errorf("got %v, want ErrOptionIllegal", err)
+	}
+}
+
+func TestStderr(t *testing.T) {
+	fail := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "sh", "-c", "cat >/dev/null; echo 'xz: something failed' >&2; exit 1")
+	}
+
+	var stderr bytes.Buffer
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard,
+		xzwriter.WithCommandFunc(fail), xzwriter.WithStderr(&stderr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closeErr := xz.Close()
+
+	var xzErr *xzwriter.XZError
+	if !errors.As(closeErr, &xzErr) {
+		t.Fatalf("got %v, want an *XZError", closeErr)
+	}
+
+	// The diagnostics are teed, not diverted.
+	if !strings.Contains(stderr.String(), "something failed") || !strings.Contains(xzErr.Stderr, "something failed") {
+		t.Errorf("teed %q, captured %q", stderr.String(), xzErr.Stderr)
+	}
+
+	stderr.Reset()
+
+	r, err := xzwriter.NewReaderWithOptions(context.Background(), strings.NewReader("data"),
+		xzwriter.WithCommandFunc(fail), xzwriter.WithStderr(&stderr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = io.ReadAll(r)
+
+	if err := r.Close(); !errors.As(err, &xzErr) || !strings.Contains(stderr.String(), "something failed") {
+		t.Errorf("reader: got %v, teed %q", err, stderr.String())
+	}
+}
+
+func TestStoreOnly(t *testing.T) {
+	for name, opt := range map[string]xzwriter.Option{
+		"level":            xzwriter.WithCompressLevel(9),
+		"format":           xzwriter.WithFormat(xzwriter.FormatXZ),
+		"check":            xzwriter.WithCheck(xzwriter.CheckCRC32),
+		"fallback":         xzwriter.WithFallback(),
+		"stream per flush": xzwriter.WithStreamPerFlush(),
+	} {
+		if err := xzwriter.ValidateOptions(xzwriter.WithStoreOnly(), opt); !errors.Is(err, xzwriter.ErrOptionIllegal) {
+			t.Errorf("%s: got %v, want ErrOptionIllegal", name, err)
+		}
+	}
+
+	requireXZ(t)
+
+	data := random(1 << 20)
+	c := compress(t, data, xzwriter.WithStoreOnly())
+
+	if len(c) > len(data)+1024 {
+		t.Errorf("stored %d bytes as %d bytes", len(data), len(c))
+	}
+
+	got, err := xzwriter.DecompressBytes(context.Background(), c, xzwriter.WithStoreOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Error("the data differs")
+	}
+}
+
+// writeLog stands for code that accepts a WriteFlushCloser.
+func writeLog(w xzwriter.WriteFlushCloser) error {
+	if _, err := io.WriteString(w, "entry\n"); err != nil {
+		return err
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+type fakeWriteFlushCloser struct {
+	bytes.Buffer
+	flushed int
+	closed  bool
+}
+
+func (f *fakeWriteFlushCloser) Flush() error {
+	f.flushed++
+
+	return nil
+}
+
+func (f *fakeWriteFlushCloser) Close() error {
+	f.closed = true
+
+	return nil
+}
+
+func TestWriteFlushCloser(t *testing.T) {
+	fake := &fakeWriteFlushCloser{}
+	if err := writeLog(fake); err != nil {
+		t.Fatal(err)
+	}
+
+	if fake.String() != "entry\n" || fake.flushed != 1 || !fake.closed {
+		t.Errorf("got %q, %d flushes, closed %v", fake.String(), fake.flushed, fake.closed)
+	}
+
+	// Other compressors fit as well.
+	if err := writeLog(gzip.NewWriter(io.Discard)); err != nil {
+		t.Error(err)
+	}
+
+	cat := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "cat")
+	}
+
+	var buf bytes.Buffer
+
+	xz, err := xzwriter.NewWithOptions(context.Background(), &buf, xzwriter.WithCommandFunc(cat))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeLog(xz); err != nil || buf.String() != "entry\n" {
+		t.Errorf("XZWriter: got %q, %v", buf.String(), err)
+	}
+}
+
+func TestSpawnRetry(t *testing.T) {
+	retry := xzwriter.WithSpawnRetry(3, time.Millisecond)
+
+	for _, tc := range []struct {
+		name     string
+		err      error // of the first failures commands
+		failures int
+		opts     []xzwriter.Option
+		calls    int
+		want     error
+	}{
+		{"no failure", syscall.EAGAIN, 0, []xzwriter.Option{retry}, 1, nil},
+		{"two failures", syscall.EAGAIN, 2, []xzwriter.Option{retry}, 3, nil},
+		{"three failures", syscall.EAGAIN, 3, []xzwriter.Option{retry}, 3, syscall.EAGAIN},
+		{"not found", exec.ErrNotFound, 1, []xzwriter.Option{retry}, 1, xzwriter.ErrXZNotFound},
+		{"no retry", syscall.EAGAIN, 1, nil, 1, syscall.EAGAIN},
+	} {
+		calls := 0
+		flaky := func(ctx context.Context, _ string, _ ...string) *exec.Cmd {
+			calls++
+
+			cmd := exec.CommandContext(ctx, "cat")
+			if calls <= tc.failures {
+				cmd.Err = tc.err
+			}
+
+			return cmd
+		}
+
+		opts := append([]xzwriter.Option{xzwriter.WithCommandFunc(flaky)}, tc.opts...)
+
+		xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, opts...)
+		if tc.want == nil && err == nil {
+			err = xz.Close()
+		}
+
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+
+		if calls != tc.calls {
+			t.Errorf("%s: %d calls, want %d", tc.name, calls, tc.calls)
+		}
+	}
+}
+
+func TestBlockCount(t *testing.T) {
+	data := random(1 << 20)
+
+	blockCount := func(opts ...xzwriter.Option) int {
+		t.Helper()
+
+		xz, err := xzwriter.NewWithOptions(context.Background(), io.Discard, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := xz.Write(data); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := xz.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		return xz.BlockCount()
+	}
+
+	fallback := []xzwriter.Option{xzwriter.WithFallback(), xzwriter.WithBinary("definitely-not-xz")}
+
+	if n := blockCount(append(fallback, xzwriter.WithBlockCount())...); n != 1 {
+		t.Errorf("fallback: BlockCount() = %d, want 1", n)
+	}
+
+	if n := blockCount(fallback...); n != -1 {
+		t.Errorf("not counted: BlockCount() = %d, want -1", n)
+	}
+
+	requireXZ(t)
+
+	for name, tc := range map[string]struct {
+		opts []xzwriter.Option
+		want int
+	}{
+		"default":    {nil, 1},
+		"block size": {[]xzwriter.Option{xzwriter.WithBlockSize(256 << 10)}, 4},
+		"lzma":       {[]xzwriter.Option{xzwriter.WithFormat(xzwriter.FormatLZMA)}, -1},
+	} {
+		if n := blockCount(append(tc.opts, xzwriter.WithBlockCount())...); n != tc.want {
+			t.Errorf("%s: BlockCount() = %d, want %d", name, n, tc.want)
+		}
+	}
+}